@@ -2,22 +2,38 @@ package main
 
 import (
 	"flag"
-	"time"
+	"strings"
 
 	"github.com/avereha/pod/pkg/api"
 	"github.com/avereha/pod/pkg/bluetooth"
+	"github.com/avereha/pod/pkg/config"
 	"github.com/avereha/pod/pkg/pod"
+	"github.com/avereha/pod/pkg/random"
 
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 )
 
 func main() {
-	var stateFile = flag.String("state", "state.toml", "pod state")
+	defaults := config.Default()
+	defaultAfter, err := defaults.DisconnectAfterDuration()
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	var configFile = flag.String("config", "", "TOML config file. flags override it")
+	var stateFile = flag.String("state", defaults.State, "pod state")
+	var adapter = flag.String("adapter", defaults.Adapter, "bluetooth adapter")
+	var apiPort = flag.Int("port", defaults.APIPort, "web API port")
+	var apiOrigins = flag.String("api-origin", "", "comma separated origins of web clients on other hosts, like http://frontend:3000. * allows any")
+	var scenario = flag.String("scenario", "", "TOML file with the command rules to load at startup")
 	var freshState = flag.Bool("fresh", false, "start fresh. not activated, empty state")
 	// if both verbose and quiet are chosen, e.g., -v -q, the verbose dominates
 	var traceLevel = flag.Bool("v", false, "verbose off by default, TraceLevel")
 	var infoLevel = flag.Bool("q", false, "quiet off by default, InfoLevel")
+	var disconnectMode = flag.String("disconnect", defaults.DisconnectPolicy, "when the pod closes the connection: idle, interval or never")
+	var disconnectAfter = flag.Duration("disconnect-after", defaultAfter, "idle time or interval for the disconnect policy")
+	var seed = flag.Int64("seed", -1, "seed for keys, nonces and IVs. 0 uses fixed values. debugging only, random by default")
+	var exposeKeys = flag.Bool("expose-keys", false, "include LTK and session keys in the API state. debugging only")
 
 	flag.Parse()
 
@@ -34,34 +50,102 @@ func main() {
 		ForceColors:  true,
 	})
 
-	// TODO: This is kinda ugly, move state reader into own file and pass state to both BLE and pod
-	state := &pod.PODState{
-		Filename: *stateFile,
+	if *seed >= 0 {
+		random.UseSeed(*seed)
+	}
+
+	cfg := defaults
+	if *configFile != "" {
+		cfg, err = config.Load(*configFile)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+	// flags given on the command line win over the config file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "state":
+			cfg.State = *stateFile
+		case "adapter":
+			cfg.Adapter = *adapter
+		case "port":
+			cfg.APIPort = *apiPort
+		case "api-origin":
+			cfg.APIOrigins = strings.Split(*apiOrigins, ",")
+		case "scenario":
+			cfg.Scenario = *scenario
+		case "disconnect":
+			cfg.DisconnectPolicy = *disconnectMode
+		case "disconnect-after":
+			cfg.DisconnectAfter = disconnectAfter.String()
+		}
+		if (f.Name == "state" || f.Name == "adapter") && len(cfg.Pods) > 0 {
+			log.Warnf("-%s is ignored, every [[pod]] in the config file has its own", f.Name)
+		}
+	})
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("%s", err)
+	}
+	log.Infof("Effective configuration:\n%s", cfg)
+
+	for _, instance := range cfg.Instances() {
+		startPod(instance, *freshState, *exposeKeys)
+	}
+	select {}
+}
+
+// startPod opens the adapter of one pod, and starts its command loop and API
+func startPod(cfg *config.Config, freshState, exposeKeys bool) {
+	version, err := cfg.PodVersion()
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	after, err := cfg.DisconnectAfterDuration()
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	mode, err := pod.ParseDisconnectMode(cfg.DisconnectPolicy)
+	if err != nil {
+		log.Fatalf("%s", err)
 	}
-	var err error
-	if !(*freshState) {
-		state, err = pod.NewState(*stateFile)
+
+	state := pod.NewFreshState(cfg.State, cfg.InitialReservoir)
+	if !freshState {
+		state, err = pod.NewState(cfg.State)
 		if err != nil {
-			log.Fatalf("pkg pod; could not restore pod state from %s: %+v", stateFile, err)
+			log.Fatalf("pkg pod; could not restore pod state from %s: %+v", cfg.State, err)
 		}
 	}
 
-	log.Tracef("podId %@ %x", state.Id, state.Id)
+	log.Tracef("%s podId %x", cfg.Adapter, state.Id)
 
-	ble, err := bluetooth.New("hci0", state.Id)
+	ble, err := bluetooth.New(cfg.Adapter, state.Id, bluetooth.Options{
+		Name:                cfg.AdvertisedName,
+		AdvertisingInterval: cfg.AdvertisingInterval(),
+		Lot:                 version.Lot,
+		Tid:                 version.Tid,
+	})
 	//defer ble.Close()
 	if err != nil {
 		log.Fatalf("Could not start BLE: %s", err)
 	}
 
-	p := pod.New(ble, *stateFile, *freshState)
+	p := pod.New(ble, state)
+	p.SetVersion(version)
+	p.SetExposeKeys(exposeKeys)
+	if cfg.Scenario != "" {
+		if err := p.LoadScenario(cfg.Scenario); err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+	if err := p.SetDisconnectPolicy(pod.DisconnectPolicy{Mode: mode, After: after}); err != nil {
+		log.Fatalf("%s", err)
+	}
 	go func() {
 		p.StartAcceptingCommands()
 	}()
 
-	log.Info("Starting API")
-	s := api.New(p)
-	s.Start()
-
-	time.Sleep(9999 * time.Second)
+	log.Infof("Starting API for %s", cfg.Adapter)
+	s := api.New(p, cfg.APIPort, cfg.APIOrigins)
+	go s.Start()
 }
@@ -4,8 +4,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/avereha/pod/pkg/bluetooth"
+	"github.com/avereha/pod/pkg/metrics"
 	"github.com/avereha/pod/pkg/pod"
+	"github.com/avereha/pod/pkg/response"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 )
@@ -14,30 +21,75 @@ type Server struct {
 	http.Handler
 
 	pod  *pod.Pod
+	addr string
+
+	// mtx serializes the writes: the command loop, the pod timers and the
+	// reader all write, and a websocket allows one writer at a time
+	mtx  sync.Mutex
 	conn *websocket.Conn
+
+	// origins are the web pages, besides the API host, that may open /ws
+	origins  []string
+	upgrader websocket.Upgrader
 }
 
-func New(pod *pod.Pod) *Server {
+// New creates the API of pod. origins are the pages of web clients served
+// from another host, like the frontend, "*" allows any page.
+func New(pod *pod.Pod, port int, origins []string) *Server {
 
 	ret := &Server{
-		pod: pod,
+		pod:     pod,
+		addr:    fmt.Sprintf(":%d", port),
+		origins: origins,
+	}
+	ret.upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     ret.checkOrigin,
 	}
 
 	return ret
 }
 
+// checkOrigin lets clients that are not browsers, pages served from the API
+// host and the allowed origins open the websocket. Otherwise any page open
+// in a browser on the network could fault or deactivate the pod.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range s.origins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	log.Warnf("pkg api; rejected websocket from %s, allow it with -api-origin", origin)
+	return false
+}
+
 func (s *Server) Start() {
-	fmt.Println("Pod simulator web api listening on :8080")
-	s.setupRoutes()
+	fmt.Printf("Pod simulator web api for %s listening on %s\n", s.pod.Name(), s.addr)
+	// every pod has its own server, so they can not share the default mux
+	mux := http.NewServeMux()
+	s.setupRoutes(mux)
 	fmt.Println("Setting Web Message Hook")
 	s.pod.SetWebMessageHook(func(msg []byte) {
 		s.sendMessage(msg)
 	})
-	http.ListenAndServe(":8080", nil)
+	if err := http.ListenAndServe(s.addr, mux); err != nil {
+		log.Errorf("pkg api; %s API stopped: %s", s.pod.Name(), err)
+	}
 }
 
+// sendMessage sends msg to the last client that connected, if any
 func (s *Server) sendMessage(msg []byte) {
-	fmt.Println("writing to websocket")
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
 	if s.conn != nil {
 		if err := s.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
 			log.Println(err)
@@ -46,11 +98,19 @@ func (s *Server) sendMessage(msg []byte) {
 	}
 }
 
-func (s *Server) setupRoutes() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+// write sends msg to conn
+func (s *Server) write(conn *websocket.Conn, msg []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+func (s *Server) setupRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "This is an API to the pod simulator intended to be used with a separate web client.")
 	})
-	http.Handle("/ws", s)
+	mux.Handle("/ws", s)
+	mux.Handle("/metrics", metrics.Default.Handler())
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -58,12 +118,15 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// upgrade this connection to a WebSocket
 	// connection
-	ws, err := upgrader.Upgrade(w, r, nil)
+	ws, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
+		return
 	}
 
+	s.mtx.Lock()
 	s.conn = ws
+	s.mtx.Unlock()
 	// listen indefinitely for new messages coming
 	// through on our WebSocket connection
 
@@ -77,7 +140,7 @@ func (s *Server) reader(conn *websocket.Conn) {
 	for {
 		// Send current state initially
 		state, err := s.pod.GetPodStateJson()
-		if err := conn.WriteMessage(websocket.TextMessage, state); err != nil {
+		if err := s.write(conn, state); err != nil {
 			log.Println(err)
 			return
 		}
@@ -106,48 +169,195 @@ func (s *Server) handleCommand(bytes []byte) {
 	)
 
 	if command, ok = msg["command"].(string); !ok {
-		log.Fatal("command is not a string or not in msg")
+		log.Error("command is not a string or not in msg")
+		return
 	}
 
 	switch command {
 	case "changeReservoir":
 		if value, ok = msg["value"].(float64); !ok {
-			log.Fatal("reservoir value is not a number or not in msg")
+			log.Error("reservoir value is not a number or not in msg")
+			return
 		}
 		s.pod.SetReservoir(float32(value))
 	case "setAlerts":
 		if value, ok = msg["value"].(float64); !ok {
-			log.Fatal("alert value is not a number or not in msg")
+			log.Error("alert value is not a number or not in msg")
+			return
 		}
 		s.pod.SetAlerts(uint8(value))
 	case "setFault":
-		if value, ok = msg["value"].(float64); !ok {
-			log.Fatal("fault value is not a number or not in msg")
+		// a fault code, or its name like "occluded"
+		code, err := response.ParseFault(fmt.Sprint(msg["value"]))
+		if err != nil {
+			log.Error(err)
+			return
 		}
-		s.pod.SetFault(uint8(value))
+		s.pod.SetFault(code)
 	case "setActiveTime":
 		if value, ok = msg["value"].(float64); !ok {
-			log.Fatal("active time in minutes is not a number or not in msg")
+			log.Error("active time in minutes is not a number or not in msg")
+			return
 		}
 		s.pod.SetActiveTime(int(value))
+	case "setDisconnectPolicy":
+		mode, err := pod.ParseDisconnectMode(fmt.Sprint(msg["mode"]))
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		seconds, _ := msg["seconds"].(float64)
+		policy := pod.DisconnectPolicy{
+			Mode:  mode,
+			After: time.Duration(seconds * float64(time.Second)),
+		}
+		if err := s.pod.SetDisconnectPolicy(policy); err != nil {
+			log.Error(err)
+		}
+	case "injectTransportFaults":
+		var req transportFaultsRequest
+		if err := json.Unmarshal(bytes, &req); err != nil {
+			log.Errorf("invalid transport faults: %s", err)
+			return
+		}
+		if err := s.pod.InjectTransportFaults(req.faultInjection(), req.PerMessage); err != nil {
+			log.Error(err)
+		}
+	case "clearTransportFaults":
+		s.pod.ClearTransportFaults()
+	case "saveSnapshot":
+		withHistory, _ := msg["history"].(bool)
+		if err := s.pod.SaveSnapshot(fmt.Sprint(msg["name"]), withHistory); err != nil {
+			log.Error(err)
+			return
+		}
+		if err := s.pod.SendSnapshotList(); err != nil {
+			log.Error(err)
+		}
+	case "restoreSnapshot":
+		if err := s.pod.RestoreSnapshot(fmt.Sprint(msg["name"])); err != nil {
+			log.Error(err)
+		}
+	case "listSnapshots":
+		if err := s.pod.SendSnapshotList(); err != nil {
+			log.Error(err)
+		}
+	case "diffSnapshots":
+		b, ok := msg["b"].(string)
+		if !ok {
+			b = pod.CurrentSnapshot
+		}
+		if err := s.pod.SendSnapshotDiff(fmt.Sprint(msg["a"]), b); err != nil {
+			log.Error(err)
+		}
+	case "pauseAdvertising":
+		if err := s.pod.PauseAdvertising(); err != nil {
+			log.Error(err)
+		}
+	case "resumeAdvertising":
+		if err := s.pod.ResumeAdvertising(); err != nil {
+			log.Error(err)
+		}
+	case "setAdvertisingInterval":
+		if value, ok = msg["ms"].(float64); !ok {
+			log.Error("advertising interval in ms is not a number or not in msg")
+			return
+		}
+		if err := s.pod.SetAdvertisingInterval(time.Duration(value * float64(time.Millisecond))); err != nil {
+			log.Error(err)
+		}
+	case "outOfRange":
+		if value, ok = msg["seconds"].(float64); !ok {
+			log.Error("out of range seconds is not a number or not in msg")
+			return
+		}
+		if err := s.pod.OutOfRange(time.Duration(value * float64(time.Second))); err != nil {
+			log.Error(err)
+		}
+	case "backInRange":
+		s.pod.BackInRange()
+	case "setFlakyConnection":
+		if value, ok = msg["rate"].(float64); !ok {
+			log.Error("flaky connection rate is not a number or not in msg")
+			return
+		}
+		if err := s.pod.SetFlakyConnection(value); err != nil {
+			log.Error(err)
+		}
+	case "loseNextResponse":
+		mode := pod.LostResponseNone
+		if m, _ := msg["mode"].(string); m != "" {
+			var err error
+			if mode, err = pod.ParseLostResponseMode(m); err != nil {
+				log.Error(err)
+				return
+			}
+		}
+		s.pod.LoseNextResponse(mode)
+	case "addRule":
+		var req struct {
+			Rule pod.Rule `json:"rule"`
+		}
+		if err := json.Unmarshal(bytes, &req); err != nil {
+			log.Errorf("invalid rule: %s", err)
+			return
+		}
+		if err := s.pod.AddRule(req.Rule); err != nil {
+			log.Error(err)
+			return
+		}
+		s.pod.SendRuleList()
+	case "removeRule":
+		if err := s.pod.RemoveRule(fmt.Sprint(msg["name"])); err != nil {
+			log.Error(err)
+			return
+		}
+		s.pod.SendRuleList()
+	case "clearRules":
+		s.pod.ClearRules()
+		s.pod.SendRuleList()
+	case "listRules":
+		s.pod.SendRuleList()
+	case "loadScenario":
+		if err := s.pod.LoadScenario(fmt.Sprint(msg["file"])); err != nil {
+			log.Error(err)
+			return
+		}
+		s.pod.SendRuleList()
 	case "crashNextCommand":
+		// kept for older clients, the pod does not exit anymore
 		var beforeProcessing bool
 		if beforeProcessing, ok = msg["beforeProcessing"].(bool); !ok {
-			log.Fatal("beforeProcessing is not a bool or not in msg")
+			log.Error("beforeProcessing is not a bool or not in msg")
+			return
+		}
+		if beforeProcessing {
+			s.pod.LoseNextResponse(pod.LostResponseNotApplied)
+		} else {
+			s.pod.LoseNextResponse(pod.LostResponseDisconnect)
 		}
-		s.pod.CrashNextCommand(beforeProcessing)
 	}
 }
 
-// We'll need to define an Upgrader
-// this will require a Read and Write buffer size
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-
-	// We'll need to check the origin of our connection
-	// this will allow us to make requests from our React
-	// development server to here.
-	// For now, we'll do no checking and just allow any connection
-	CheckOrigin: func(r *http.Request) bool { return true },
+type transportFaultsRequest struct {
+	PerMessage       bool   `json:"perMessage"`
+	DelayCTSMs       int    `json:"delayCtsMs"`
+	WithholdCTS      bool   `json:"withholdCts"`
+	RTSReply         string `json:"rtsReply"`
+	DelaySuccessMs   int    `json:"delaySuccessMs"`
+	DropFragments    []int  `json:"dropFragments"`
+	ReorderFragments bool   `json:"reorderFragments"`
+	CorruptCRC       bool   `json:"corruptCrc"`
+}
+
+func (r *transportFaultsRequest) faultInjection() bluetooth.FaultInjection {
+	return bluetooth.FaultInjection{
+		DelayCTS:         time.Duration(r.DelayCTSMs) * time.Millisecond,
+		WithholdCTS:      r.WithholdCTS,
+		RTSReply:         r.RTSReply,
+		DelaySuccess:     time.Duration(r.DelaySuccessMs) * time.Millisecond,
+		DropFragments:    r.DropFragments,
+		ReorderFragments: r.ReorderFragments,
+		CorruptCRC:       r.CorruptCRC,
+	}
 }
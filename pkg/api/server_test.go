@@ -0,0 +1,92 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestServer_CheckOrigin(t *testing.T) {
+	s := New(nil, 8080, []string{"http://frontend:3000/"})
+	for origin, want := range map[string]bool{
+		"":                         true, // not a browser
+		"http://raspberrypi:8080":  true, // same host
+		"http://frontend:3000":     true,
+		"http://frontend:3001":     false,
+		"https://evil.example.com": false,
+	} {
+		r := httptest.NewRequest("GET", "http://raspberrypi:8080/ws", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if got := s.checkOrigin(r); got != want {
+			t.Errorf("origin %q: got %v, want %v", origin, got, want)
+		}
+	}
+	r := httptest.NewRequest("GET", "http://raspberrypi:8080/ws", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	if !New(nil, 8080, []string{"*"}).checkOrigin(r) {
+		t.Errorf("* should allow any origin")
+	}
+}
+
+func TestServer_ConcurrentWrites(t *testing.T) {
+	s := New(nil, 8080, nil)
+	connected := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := s.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		s.mtx.Lock()
+		s.conn = ws
+		s.mtx.Unlock()
+		close(connected)
+	}))
+	defer srv.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	<-connected
+
+	// the command loop and the beep and alert timers send at the same time
+	const writers, messages = 8, 20
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				s.sendMessage([]byte(`{"type":"beep"}`))
+			}
+		}()
+	}
+	for i := 0; i < writers*messages; i++ {
+		if _, msg, err := client.ReadMessage(); err != nil || string(msg) != `{"type":"beep"}` {
+			t.Fatalf("message %d: %q, %v", i, msg, err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestServer_HandleCommand_Malformed(t *testing.T) {
+	// answered with an error in the log, without touching the pod
+	s := New(nil, 8080, nil)
+	for _, msg := range []string{
+		`not json`,
+		`{"command": 5}`,
+		`{"command": "changeReservoir"}`,
+		`{"command": "setAlerts", "value": "all"}`,
+		`{"command": "setActiveTime"}`,
+	} {
+		s.handleCommand([]byte(msg))
+	}
+}
@@ -0,0 +1,163 @@
+package bluetooth
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/paypal/gatt"
+	"github.com/paypal/gatt/linux/cmd"
+	log "github.com/sirupsen/logrus"
+)
+
+// AdvertisingState is the part of the pod lifecycle the advertisements show
+type AdvertisingState byte
+
+const (
+	// Not paired yet, the pod ID is 0xfffffffe and the app can pair with it
+	AdvertiseUnpaired AdvertisingState = iota
+	// Paired, the pod advertises the ID the app gave it
+	AdvertisePaired
+	// Deactivated, the pod keeps its ID but is not discoverable anymore
+	AdvertiseInactive
+)
+
+var advertisingStateNames = map[AdvertisingState]string{
+	AdvertiseUnpaired: "unpaired",
+	AdvertisePaired:   "paired",
+	AdvertiseInactive: "inactive",
+}
+
+func (s AdvertisingState) String() string {
+	if name, ok := advertisingStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("AdvertisingState(%d)", byte(s))
+}
+
+// Advertisement is what the pod tells the centrals that scan for it
+type Advertisement struct {
+	State AdvertisingState
+	// 4 bytes, ignored until the pod is paired
+	PodId []byte
+}
+
+func (a Advertisement) equal(o Advertisement) bool {
+	return a.State == o.State && bytes.Equal(a.PodId, o.PodId)
+}
+
+// The advertising interval the controller accepts
+const (
+	MinAdvertisingInterval = 20 * time.Millisecond
+	MaxAdvertisingInterval = 10240 * time.Millisecond
+)
+
+const (
+	advFlagGeneralDiscoverable = 0x02
+	advFlagLEOnly              = 0x04
+)
+
+func advertisingParameters(interval time.Duration) *cmd.LESetAdvertisingParameters {
+	// the controller counts the interval in 0.625ms units
+	units := uint16(interval * 10 / 6250 / time.Microsecond)
+	return &cmd.LESetAdvertisingParameters{
+		AdvertisingIntervalMin: units,
+		AdvertisingIntervalMax: units,
+		AdvertisingChannelMap:  0x7,
+	}
+}
+
+// Advertise changes what the pod advertises. It does nothing when a is
+// already advertised, and does not resume paused advertising.
+func (b *Ble) Advertise(a Advertisement) error {
+	b.advMtx.Lock()
+	defer b.advMtx.Unlock()
+	if a.equal(b.advertisement) {
+		return nil
+	}
+	log.Infof("pkg bluetooth; advertising %s, pod ID: %x", a.State, a.PodId)
+	b.advertisement = a
+	return b.startAdvertising()
+}
+
+// PauseAdvertising stops advertising until ResumeAdvertising. A connected
+// central stays connected.
+func (b *Ble) PauseAdvertising() error {
+	b.advMtx.Lock()
+	defer b.advMtx.Unlock()
+	log.Infof("pkg bluetooth; pausing advertising on %s", b.adapter)
+	b.advertisingPaused = true
+	if !b.poweredOn {
+		return nil
+	}
+	return (*b.device).StopAdvertising()
+}
+
+func (b *Ble) ResumeAdvertising() error {
+	b.advMtx.Lock()
+	defer b.advMtx.Unlock()
+	log.Infof("pkg bluetooth; resuming advertising on %s", b.adapter)
+	b.advertisingPaused = false
+	return b.startAdvertising()
+}
+
+func (b *Ble) SetAdvertisingInterval(interval time.Duration) error {
+	if interval < MinAdvertisingInterval || interval > MaxAdvertisingInterval {
+		return fmt.Errorf("advertising interval %s is out of range, %s to %s", interval, MinAdvertisingInterval, MaxAdvertisingInterval)
+	}
+	b.advMtx.Lock()
+	defer b.advMtx.Unlock()
+	log.Infof("pkg bluetooth; advertising every %s on %s", interval, b.adapter)
+	b.options.AdvertisingInterval = interval
+	// sent to the controller with the next advertising data
+	if err := (*b.device).Option(gatt.LnxSetAdvertisingParameters(advertisingParameters(interval))); err != nil {
+		return err
+	}
+	return b.startAdvertising()
+}
+
+// AdvertisingStatus returns what is advertised, whether advertising is
+// paused and how often the pod advertises
+func (b *Ble) AdvertisingStatus() (Advertisement, bool, time.Duration) {
+	b.advMtx.Lock()
+	defer b.advMtx.Unlock()
+	return b.advertisement, b.advertisingPaused, b.options.AdvertisingInterval
+}
+
+// startAdvertising sends the advertisement to the controller, once it is
+// powered on. advMtx must be held.
+func (b *Ble) startAdvertising() error {
+	if !b.poweredOn || b.advertisingPaused {
+		return nil
+	}
+	a := b.advertisement
+
+	var podId []byte
+	flags := byte(advFlagGeneralDiscoverable | advFlagLEOnly)
+	switch a.State {
+	case AdvertisePaired:
+		podId = a.PodId
+	case AdvertiseInactive:
+		podId = a.PodId
+		flags = advFlagLEOnly
+	}
+	adv := &gatt.AdvPacket{}
+	adv.AppendFlags(flags)
+	adv.AppendUUIDFit(b.advertisedServices(podId))
+
+	// the name does not fit with the UUIDs
+	scanResponse := &gatt.AdvPacket{}
+	scanResponse.AppendName(b.options.Name)
+	err := (*b.device).Option(gatt.LnxSetScanResponseData(&cmd.LESetScanResponseData{
+		ScanResponseDataLength: uint8(scanResponse.Len()),
+		ScanResponseData:       scanResponse.Bytes(),
+	}))
+	if err != nil {
+		return err
+	}
+	if err := (*b.device).Advertise(adv); err != nil {
+		log.Infof("pkg bluetooth; could not advertise: %s", err)
+		return err
+	}
+	return nil
+}
@@ -7,13 +7,15 @@ import (
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/avereha/pod/pkg/message"
+	"github.com/avereha/pod/pkg/metrics"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/paypal/gatt"
-	"github.com/paypal/gatt/linux/cmd"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -28,6 +30,16 @@ var (
 	CmdFail    = Packet([]byte{5})
 )
 
+var (
+	bleSessions         = metrics.NewCounterVec("pod_ble_sessions_total", "BLE connections from a central.", "pod")
+	bleChecksumFailures = metrics.NewCounterVec("pod_ble_checksum_failures_total", "Received messages with a CRC32 mismatch.", "pod")
+	bleNacks            = metrics.NewCounterVec("pod_ble_nacks_total", "NACKs sent to or received from the central.", "pod", "direction")
+	bleRetransmissions  = metrics.NewCounterVec("pod_ble_retransmissions_total", "Outbound messages or fragments sent again, by the reason the central gave.", "pod", "reason")
+	bleAborts           = metrics.NewCounterVec("pod_ble_aborts_total", "Outbound messages aborted by the central.", "pod")
+
+	bleRefusedConnections = metrics.NewCounterVec("pod_ble_refused_connections_total", "Connections closed right away, while the pod simulates being out of range.", "pod")
+)
+
 type Ble struct {
 	dataInput  chan Packet
 	cmdInput   chan Packet
@@ -36,32 +48,105 @@ type Ble struct {
 
 	messageInput  chan *message.Message
 	messageOutput chan *message.Message
+	loopErrors    chan error
 
+	// mtx protects stopLoop and central, which change when the central
+	// connects or disconnects
+	mtx      sync.Mutex
 	stopLoop chan bool
 	device   *gatt.Device
 	central  *gatt.Central
+	// set while new connections are refused
+	onRefused func(central string)
 
 	cmdNotifier    gatt.Notifier
 	cmdNotifierMtx sync.Mutex
 
 	dataNotifier    gatt.Notifier
 	dataNotifierMtx sync.Mutex
+
+	faultsMtx     sync.Mutex
+	sessionFaults *FaultInjection
+	messageFaults *FaultInjection
+
+	adapter string
+
+	// advMtx protects options, and what is advertised
+	advMtx            sync.Mutex
+	options           Options
+	advertisement     Advertisement
+	advertisingPaused bool
+	poweredOn         bool
+}
+
+// Options is what the pod advertises, and how often
+type Options struct {
+	Name                string
+	AdvertisingInterval time.Duration
+	// Lot and TID of the pod, also reported in the version responses
+	Lot uint32
+	Tid uint32
+}
+
+var DefaultOptions = Options{
+	Name:                " :: Fake POD ::",
+	AdvertisingInterval: 152500 * time.Microsecond,
+	Lot:                 0x08146DB1,
+	Tid:                 0x0006E451,
+}
+
+var (
+	ErrReadTimeout       = errors.New("timeout reading message")
+	ErrChecksum          = errors.New("checksum missmatch")
+	ErrUnexpectedCommand = errors.New("unexpected BLE command")
+	ErrMalformedFragment = errors.New("malformed data fragment")
+	ErrDisconnected      = errors.New("central disconnected")
+	ErrAborted           = errors.New("message aborted by the central")
+
+	errTransferFailed = errors.New("central reported a failed transfer")
+)
+
+const (
+	// How many times we send a message the central answers with Fail
+	maxMessageAttempts = 3
+	// How many NACKs we answer for a single attempt
+	maxNacks = 5
+)
+
+// ParseAdapterID returns the index of an HCI device given by name, like
+// hci1, or by index. An empty ID means the first adapter that supports LE.
+func ParseAdapterID(adapterID string) (int, error) {
+	if adapterID == "" {
+		return -1, nil
+	}
+	index, err := strconv.Atoi(strings.TrimPrefix(adapterID, "hci"))
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("invalid bluetooth adapter %q. Use its name, like hci0, or its index", adapterID)
+	}
+	return index, nil
 }
 
-var DefaultServerOptions = []gatt.Option{
-	gatt.LnxMaxConnections(1),
-	gatt.LnxDeviceID(-1, true),
-	gatt.LnxSetAdvertisingParameters(&cmd.LESetAdvertisingParameters{
-		AdvertisingIntervalMin: 0x00f4,
-		AdvertisingIntervalMax: 0x00f4,
-		AdvertisingChannelMap:  0x7,
-	}),
+// ServerOptions returns the gatt options to use the HCI device deviceID and
+// advertise every interval
+func ServerOptions(deviceID int, interval time.Duration) []gatt.Option {
+	return []gatt.Option{
+		gatt.LnxMaxConnections(1),
+		gatt.LnxDeviceID(deviceID, true),
+		gatt.LnxSetAdvertisingParameters(advertisingParameters(interval)),
+	}
 }
 
-func New(adapterID string, podId []byte) (*Ble, error) {
-	d, err := gatt.NewDevice(DefaultServerOptions...)
+// New opens the HCI device adapterID and advertises the pod, as unpaired
+// until podId is set. Each Ble needs its own adapter, several of them can run
+// in the same process.
+func New(adapterID string, podId []byte, options Options) (*Ble, error) {
+	deviceID, err := ParseAdapterID(adapterID)
 	if err != nil {
-		log.Fatalf("pkg bluetooth; failed to open device, err: %s", err)
+		return nil, err
+	}
+	d, err := gatt.NewDevice(ServerOptions(deviceID, options.AdvertisingInterval)...)
+	if err != nil {
+		return nil, fmt.Errorf("could not open bluetooth adapter %q: %w", adapterID, err)
 	}
 
 	b := &Ble{
@@ -71,17 +156,36 @@ func New(adapterID string, podId []byte) (*Ble, error) {
 		cmdOutput:     make(chan Packet, 5),
 		messageInput:  make(chan *message.Message, 5),
 		messageOutput: make(chan *message.Message, 2),
+		loopErrors:    make(chan error, 1),
 		device:        &d,
+		adapter:       adapterID,
+		options:       options,
+	}
+	if podId != nil {
+		b.advertisement = Advertisement{State: AdvertisePaired, PodId: podId}
 	}
 
 	d.Handle(
 		gatt.CentralConnected(func(c gatt.Central) {
-			fmt.Println("pkg bluetooth; ** New connection from: ", c.ID())
-			// b.StopMessageLoop()
-			b.central = &c
+			b.mtx.Lock()
+			onRefused := b.onRefused
+			if onRefused == nil {
+				b.central = &c
+			}
+			b.mtx.Unlock()
+			if onRefused != nil {
+				log.Infof("pkg bluetooth; ** refusing connection on %s from: %s", adapterID, c.ID())
+				bleRefusedConnections.Inc(b.adapter)
+				c.Close()
+				onRefused(c.ID())
+				return
+			}
+			fmt.Println("pkg bluetooth; ** New connection on", adapterID, "from: ", c.ID())
+			bleSessions.Inc(b.adapter)
 		}),
 		gatt.CentralDisconnected(func(c gatt.Central) {
-			log.Tracef("pkg bluetooth; ** disconnect: %s", c.ID())
+			log.Infof("pkg bluetooth; ** disconnect on %s: %s", adapterID, c.ID())
+			b.resetConnection()
 		}),
 	)
 
@@ -90,15 +194,8 @@ func New(adapterID string, podId []byte) (*Ble, error) {
 		for {
 			packet := <-b.cmdOutput
 			b.cmdNotifierMtx.Lock()
-			if b.cmdNotifier.Done() {
-				log.Fatalf("pkg bluetooth; CMD closed")
-			}
-			ret, err := b.cmdNotifier.Write(packet)
+			b.notify("CMD", b.cmdNotifier, packet)
 			b.cmdNotifierMtx.Unlock()
-			log.Tracef("pkg bluetooth; CMD notification return: %d/%s", ret, hex.EncodeToString(packet))
-			if err != nil {
-				log.Fatalf("pkg bluetooth; error writing CMD: %s", err)
-			}
 		}
 	}()
 
@@ -107,21 +204,14 @@ func New(adapterID string, podId []byte) (*Ble, error) {
 		for {
 			packet := <-b.dataOutput
 			b.dataNotifierMtx.Lock()
-			if b.dataNotifier.Done() {
-				log.Fatalf("pkg bluetooth; DATA closed")
-			}
-			ret, err := b.dataNotifier.Write(packet)
+			b.notify("DATA", b.dataNotifier, packet)
 			b.dataNotifierMtx.Unlock()
-			log.Tracef("pkg bluetooth; DATA notification return: %d/%s", ret, hex.EncodeToString(packet))
-			if err != nil {
-				log.Fatalf("pkg bluetooth; error writing DATA: %s ", err)
-			}
 		}
 	}()
 
 	// A mandatory handler for monitoring device state.
 	onStateChanged := func(d gatt.Device, s gatt.State) {
-		fmt.Printf("state: %s\n", s)
+		fmt.Printf("%s state: %s\n", adapterID, s)
 		switch s {
 		case gatt.StatePoweredOn:
 			var serviceUUID = gatt.MustParseUUID("1a7e-4024-e3ed-4464-8b7e-751e03d0dc5f")
@@ -172,29 +262,10 @@ func New(adapterID string, podId []byte) (*Ble, error) {
 				log.Fatalf("pkg bluetooth; could not add service: %s", err)
 			}
 
-			podIdServiceOne := gatt.UUID16(0xffff)
-			podIdServiceTwo := gatt.UUID16(0xfffe)
-			if podId != nil {
-				podIdServiceOne = gatt.UUID16(binary.BigEndian.Uint16(podId[0:2]))
-				podIdServiceTwo = gatt.UUID16(binary.BigEndian.Uint16(podId[2:4]))
-			}
-
-			// Advertise device name and service's UUIDs.
-			err = d.AdvertiseNameAndServices(" :: Fake POD ::", []gatt.UUID{
-				gatt.UUID16(0x4024),
-
-				gatt.UUID16(0x2470),
-				gatt.UUID16(0x000a),
-
-				podIdServiceOne,
-				podIdServiceTwo,
-
-				// these 4 are copied from lotNo and lotSeq from fixed string in versionresponse.go
-				gatt.UUID16(0x0814),
-				gatt.UUID16(0x6DB1),
-				gatt.UUID16(0x0006),
-				gatt.UUID16(0xE451),
-			})
+			b.advMtx.Lock()
+			b.poweredOn = true
+			err = b.startAdvertising()
+			b.advMtx.Unlock()
 			if err != nil {
 				log.Fatalf("pkg bluetooth; could not advertise: %s", err)
 			}
@@ -203,37 +274,90 @@ func New(adapterID string, podId []byte) (*Ble, error) {
 	}
 	err = d.Init(onStateChanged)
 	if err != nil {
-		log.Fatalf("pkg bluetooth; could not init bluetooth: %s", err)
+		return nil, fmt.Errorf("could not init bluetooth adapter %q: %w", adapterID, err)
 	}
 	return b, nil
 }
 
-func (b *Ble) RefreshAdvertisingWithSpecifiedId(id []byte) error { // 4 bytes, first 2 usually empty
-	log.Debugf("RefreshAdvertisingWithSpecifiedId %x", id)
-	// Looking at the paypal/gatt source code, we don't need to call StopAdvertising,
-	// but just call AdvertiseNameAndServices and it should update
+// notify writes packet on characteristic n. Packets for a central that is
+// gone are dropped, the session is reset by the disconnect handler.
+func (b *Ble) notify(name string, n gatt.Notifier, packet Packet) {
+	if n == nil || n.Done() {
+		log.Warnf("pkg bluetooth; %s closed, dropping %s", name, packet)
+		return
+	}
+	ret, err := n.Write(packet)
+	log.Tracef("pkg bluetooth; %s notification return: %d/%s", name, ret, hex.EncodeToString(packet))
+	if err != nil {
+		log.Warnf("pkg bluetooth; error writing %s: %s", name, err)
+	}
+}
+
+// resetConnection cancels whatever the messaging loop was doing and
+// forgets the state of the central that just went away
+func (b *Ble) resetConnection() {
+	b.StopMessageLoop()
+
+	b.mtx.Lock()
+	b.central = nil
+	b.mtx.Unlock()
+
+	b.cmdNotifierMtx.Lock()
+	b.cmdNotifier = nil
+	b.cmdNotifierMtx.Unlock()
+	b.dataNotifierMtx.Lock()
+	b.dataNotifier = nil
+	b.dataNotifierMtx.Unlock()
+
+	b.ClearFaults()
+
+	// drop partially received fragments and unsent packets
+	drainPackets(b.cmdInput)
+	drainPackets(b.dataInput)
+	drainPackets(b.cmdOutput)
+	drainPackets(b.dataOutput)
+}
 
-	log.Tracef("podIdServiceOne", gatt.UUID16(binary.BigEndian.Uint16(id[0:2])))
-	log.Tracef("podIdServiceTwo", gatt.UUID16(binary.BigEndian.Uint16(id[2:4])))
-	err := (*b.device).AdvertiseNameAndServices(" :: Fake POD ::", []gatt.UUID{
+func drainPackets(c chan Packet) {
+	for {
+		select {
+		case <-c:
+		default:
+			return
+		}
+	}
+}
+
+// advertisedServices are the UUIDs the app looks for: the pod ID, 0xffff 0xfffe
+// before pairing, followed by the lot and TID. advMtx must be held.
+func (b *Ble) advertisedServices(podId []byte) []gatt.UUID {
+	podIdServiceOne := gatt.UUID16(0xffff)
+	podIdServiceTwo := gatt.UUID16(0xfffe)
+	if podId != nil {
+		podIdServiceOne = gatt.UUID16(binary.BigEndian.Uint16(podId[0:2]))
+		podIdServiceTwo = gatt.UUID16(binary.BigEndian.Uint16(podId[2:4]))
+	}
+	log.Tracef("podIdServiceOne %s", podIdServiceOne)
+	log.Tracef("podIdServiceTwo %s", podIdServiceTwo)
+	return []gatt.UUID{
 		gatt.UUID16(0x4024),
 
 		gatt.UUID16(0x2470),
 		gatt.UUID16(0x000a),
 
-		gatt.UUID16(binary.BigEndian.Uint16(id[0:2])),
-		gatt.UUID16(binary.BigEndian.Uint16(id[2:4])),
+		podIdServiceOne,
+		podIdServiceTwo,
 
-		// these 4 are copied from lotNo and lotSeq from fixed string in versionresponse.go
-		gatt.UUID16(0x0814),
-		gatt.UUID16(0x6DB1),
-		gatt.UUID16(0x0006),
-		gatt.UUID16(0xE451),
-	})
-	if err != nil {
-		log.Infof("pkg bluetooth; could not re-advertise: %s", err)
+		gatt.UUID16(uint16(b.options.Lot >> 16)),
+		gatt.UUID16(uint16(b.options.Lot)),
+		gatt.UUID16(uint16(b.options.Tid >> 16)),
+		gatt.UUID16(uint16(b.options.Tid)),
 	}
-	return err
+}
+
+// Adapter is the HCI device this Ble was opened on
+func (b *Ble) Adapter() string {
+	return b.adapter
 }
 
 func (b *Ble) WriteCmd(packet Packet) error {
@@ -247,13 +371,6 @@ func (b *Ble) WriteData(packet Packet) error {
 	return nil
 }
 
-func (b *Ble) writeDataBuffer(buf *bytes.Buffer) error {
-	data := make([]byte, buf.Len())
-	copy(data, buf.Bytes())
-	buf.Reset()
-	return b.WriteData(data)
-}
-
 func (b *Ble) ReadCmd() (Packet, error) {
 	packet := <-b.cmdInput
 	return packet, nil
@@ -264,31 +381,107 @@ func (b *Ble) ReadData() (Packet, error) {
 	return packet, nil
 }
 
+// readCmd and readData are used by the messaging loop, they give up
+// when the loop is stopped
+func (b *Ble) readCmd(stop chan bool) (Packet, error) {
+	select {
+	case packet := <-b.cmdInput:
+		return packet, nil
+	case <-stop:
+		return nil, ErrDisconnected
+	}
+}
+
+func (b *Ble) readData(stop chan bool) (Packet, error) {
+	select {
+	case packet := <-b.dataInput:
+		return packet, nil
+	case <-stop:
+		return nil, ErrDisconnected
+	}
+}
+
 func (p Packet) String() string {
 	return hex.EncodeToString(p)
 }
 
+func (b *Ble) currentLoop() chan bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.stopLoop
+}
+
+// ReadMessage returns the next message from the central, or the error
+// that stopped the messaging loop
 func (b *Ble) ReadMessage() (*message.Message, error) {
-	message := <-b.messageInput
-	return message, nil
+	return b.readMessageUntil(nil)
+}
+
+func (b *Ble) ReadMessageWithTimeout(d time.Duration) (*message.Message, error) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	return b.readMessageUntil(timer.C)
 }
 
-func (b *Ble) ReadMessageWithTimeout(d time.Duration) (*message.Message, bool) {
+func (b *Ble) readMessageUntil(timeout <-chan time.Time) (*message.Message, error) {
+	stop := b.currentLoop()
+	if stop == nil {
+		return nil, ErrDisconnected
+	}
 	select {
 	case message := <-b.messageInput:
-		return message, false
-	case <-time.After(d):
+		return message, nil
+	case err := <-b.loopErrors:
+		return nil, err
+	case <-stop:
+		return nil, ErrDisconnected
+	case <-timeout:
 		log.Debugf("ReadMessage timeout")
-		return nil, true
+		return nil, ErrReadTimeout
+	}
+}
+
+// RefuseConnections closes every new connection and calls onRefused with
+// the ID of the central. nil accepts connections again.
+func (b *Ble) RefuseConnections(onRefused func(central string)) {
+	b.mtx.Lock()
+	b.onRefused = onRefused
+	b.mtx.Unlock()
+}
+
+// Sleep waits for d, or until the current connection is closed
+func (b *Ble) Sleep(d time.Duration) error {
+	stop := b.currentLoop()
+	if stop == nil {
+		return ErrDisconnected
 	}
+	return sleep(stop, d)
 }
 
 func (b *Ble) ShutdownConnection() {
-	(*b.central).Close()
+	b.mtx.Lock()
+	central := b.central
+	b.mtx.Unlock()
+	if central == nil {
+		return
+	}
+	(*central).Close()
 }
 
-func (b *Ble) WriteMessage(message *message.Message) {
-	b.messageOutput <- message
+// WriteMessage queues a message for the central. It fails with
+// ErrDisconnected when the central is gone before the message was queued.
+func (b *Ble) WriteMessage(message *message.Message) error {
+	stop := b.currentLoop()
+	if stop == nil {
+		log.Warnf("pkg bluetooth; not connected, dropping message")
+		return ErrDisconnected
+	}
+	select {
+	case b.messageOutput <- message:
+		return nil
+	case <-stop:
+		return ErrDisconnected
+	}
 }
 
 func (b *Ble) loop(stop chan bool) {
@@ -297,53 +490,197 @@ func (b *Ble) loop(stop chan bool) {
 		case <-stop:
 			return
 		case msg := <-b.messageOutput:
-			b.writeMessage(msg)
+			err := b.writeMessage(stop, msg)
+			if errors.Is(err, ErrAborted) {
+				log.Warnf("pkg bluetooth; central aborted the message, dropping it")
+				bleAborts.Inc(b.adapter)
+				continue
+			}
+			if err != nil {
+				b.loopFailed(stop, fmt.Errorf("error writing message: %w", err))
+				return
+			}
 		case cmd := <-b.cmdInput:
-			msg, err := b.readMessage(cmd)
+			msg, err := b.readMessage(stop, cmd)
 			if err != nil {
-				log.Fatalf("pkg bluetooth; error reading message: %s", err)
+				b.loopFailed(stop, fmt.Errorf("error reading message: %w", err))
+				return
+			}
+			if msg == nil {
+				continue // refused by an injected fault, the central will try again
+			}
+			select {
+			case b.messageInput <- msg:
+			case <-stop:
+				return
 			}
-			b.messageInput <- msg
 		}
 	}
 }
 
+// loopFailed hands the error that stopped the loop to the next reader
+func (b *Ble) loopFailed(stop chan bool, err error) {
+	select {
+	case <-stop:
+		return // stopped on purpose, nothing to report
+	default:
+	}
+	log.Warnf("pkg bluetooth; messaging loop stopped: %s", err)
+	select {
+	case b.loopErrors <- err:
+	default:
+	}
+}
+
 func (b *Ble) StartMessageLoop() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
 	if b.stopLoop != nil {
-		log.Fatalf("pkg bluetooth; Messaging loop is already running")
+		log.Warnf("pkg bluetooth; Messaging loop is already running, restarting it")
+		close(b.stopLoop)
+	}
+	// drop whatever the previous session left behind
+	for len(b.loopErrors) > 0 {
+		<-b.loopErrors
+	}
+	for len(b.messageInput) > 0 {
+		<-b.messageInput
+	}
+	for len(b.messageOutput) > 0 {
+		<-b.messageOutput
 	}
 	b.stopLoop = make(chan bool)
 	go b.loop(b.stopLoop)
 }
 
 func (b *Ble) StopMessageLoop() {
-	// race condition, but this is called only on device disconnect
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
 	if b.stopLoop != nil {
 		close(b.stopLoop)
 		b.stopLoop = nil
 	}
 }
 
-func (b *Ble) expectCommand(expected Packet) {
-	cmd, _ := b.ReadCmd()
+func (b *Ble) expectCommand(stop chan bool, expected Packet) error {
+	cmd, err := b.readCmd(stop)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(CmdNACK[:1], cmd[:1]) {
+		bleNacks.Inc(b.adapter, "received")
+	}
 	if !bytes.Equal(expected[:1], cmd[:1]) {
-		log.Fatalf("pkg bluetooth; expected command: %s. received command: %s", expected, cmd)
+		return fmt.Errorf("%w: expected: %s. received: %s", ErrUnexpectedCommand, expected, cmd)
+	}
+	return nil
+}
+
+func (b *Ble) writeMessage(stop chan bool, msg *message.Message) error {
+	data, err := msg.Marshal()
+	if err != nil {
+		return fmt.Errorf("could not marshal the message: %w", err)
+	}
+	log.Tracef("pkg bluetooth; Sending message: %x", data)
+
+	faults := b.takeFaults(true)
+	for attempt := 1; ; attempt++ {
+		err := b.sendMessage(stop, data, faults)
+		if !errors.Is(err, errTransferFailed) {
+			return err
+		}
+		if attempt == maxMessageAttempts {
+			return fmt.Errorf("%w after %d attempts", err, attempt)
+		}
+		log.Warnf("pkg bluetooth; central reported a failed transfer, sending the message again")
+		bleRetransmissions.Inc(b.adapter, "fail")
+		// injected faults only apply to the first attempt
+		faults = &FaultInjection{}
+	}
+}
+
+// sendMessage does one RTS/CTS exchange and sends all the fragments of
+// data, resending them from the requested index when the central NACKs
+func (b *Ble) sendMessage(stop chan bool, data []byte, faults *FaultInjection) error {
+	b.WriteCmd(CmdRTS)
+	if err := b.expectCommand(stop, CmdCTS); err != nil { // TODO figure out what to do if !CTS
+		return err
+	}
+	sum := crc32.ChecksumIEEE(data)
+	fragments := splitMessage(data, sum)
+
+	sent := fragments
+	if faults.CorruptCRC {
+		log.Infof("pkg bluetooth; injected fault: corrupting CRC32")
+		sent = splitMessage(data, ^sum)
+	}
+	if faults.ReorderFragments && len(sent) > 1 {
+		log.Infof("pkg bluetooth; injected fault: swapping fragments 0 and 1")
+		sent = append([]Packet{sent[1], sent[0]}, sent[2:]...)
+	}
+	for i, fragment := range sent {
+		if faults.dropFragment(int(fragment[0])) {
+			log.Infof("pkg bluetooth; injected fault: dropping fragment %d", fragment[0])
+			continue
+		}
+		log.Tracef("pkg bluetooth; sending fragment %d/%d: %s", i+1, len(sent), fragment)
+		b.WriteData(fragment)
+	}
+
+	// the central answers short messages too, a corrupted one with Fail
+	for nacks := 0; ; nacks++ {
+		cmd, err := b.readCmd(stop)
+		if err != nil {
+			return err
+		}
+		if len(cmd) == 0 {
+			return fmt.Errorf("%w: empty command", ErrUnexpectedCommand)
+		}
+		switch cmd[0] {
+		case CmdSuccess[0]:
+			return nil
+		case CmdFail[0]:
+			return errTransferFailed
+		case CmdAbort[0]:
+			return ErrAborted
+		case CmdNACK[0]:
+			bleNacks.Inc(b.adapter, "received")
+			if len(cmd) < 2 {
+				return fmt.Errorf("%w: NACK without fragment index: %s", ErrUnexpectedCommand, cmd)
+			}
+			if nacks == maxNacks {
+				return fmt.Errorf("%w: too many NACKs, last one: %s", ErrUnexpectedCommand, cmd)
+			}
+			from := int(cmd[1])
+			log.Warnf("pkg bluetooth; central NACKed fragment %d, sending again from there", from)
+			bleRetransmissions.Inc(b.adapter, "nack")
+			for _, fragment := range fragments {
+				if int(fragment[0]) >= from {
+					b.WriteData(fragment)
+				}
+			}
+		default:
+			return fmt.Errorf("%w: expected: %s. received: %s", ErrUnexpectedCommand, CmdSuccess, cmd)
+		}
 	}
 }
 
-func (b *Ble) writeMessage(msg *message.Message) {
+// splitMessage cuts a marshaled message in data fragments. The CRC32 goes
+// in the first fragment of short messages, and in the last full fragment
+// of the long ones.
+func splitMessage(data []byte, sum uint32) []Packet {
 	var buf bytes.Buffer
 	var index byte = 0
+	var ret []Packet
 
-	b.WriteCmd(CmdRTS)
-	b.expectCommand(CmdCTS) // TODO figure out what to do if !CTS
-	bytes, err := msg.Marshal()
-	if err != nil {
-		log.Fatalf("pkg bluetooth; could not marshal the message %s", err)
+	flush := func() {
+		fragment := make([]byte, buf.Len())
+		copy(fragment, buf.Bytes())
+		buf.Reset()
+		ret = append(ret, fragment)
 	}
-	log.Tracef("pkg bluetooth; Sending message: %x", bytes)
-	sum := crc32.ChecksumIEEE(bytes)
-	if len(bytes) <= 18 {
+
+	if len(data) <= 18 {
 		buf.WriteByte(index) // index
 		buf.WriteByte(0)     // fragments
 
@@ -351,40 +688,40 @@ func (b *Ble) writeMessage(msg *message.Message) {
 		buf.WriteByte(byte(sum >> 16))
 		buf.WriteByte(byte(sum >> 8))
 		buf.WriteByte(byte(sum))
-		buf.WriteByte((byte(len(bytes))))
-		end := len(bytes)
-		if len(bytes) > 14 {
+		buf.WriteByte((byte(len(data))))
+		end := len(data)
+		if len(data) > 14 {
 			end = 14
 		}
-		buf.Write(bytes[:end])
-		b.writeDataBuffer(&buf)
+		buf.Write(data[:end])
+		flush()
 
-		if len(bytes) > 14 {
+		if len(data) > 14 {
 			buf.WriteByte(index)
-			buf.WriteByte(byte(len(bytes) - 14))
-			buf.Write(bytes[14:])
-			b.writeDataBuffer(&buf)
+			buf.WriteByte(byte(len(data) - 14))
+			buf.Write(data[14:])
+			flush()
 		}
-		return
+		return ret
 	}
 
-	size := len(bytes)
+	size := len(data)
 	fullFragments := (byte)((size - 18) / 19)
 	rest := (byte)((size - (int(fullFragments) * 19)) - 18)
 	buf.WriteByte(index)
 	buf.WriteByte(fullFragments + 1)
-	buf.Write(bytes[:18])
+	buf.Write(data[:18])
 
-	b.writeDataBuffer(&buf)
+	flush()
 
 	for index = 1; index <= fullFragments; index++ {
 		buf.WriteByte(index)
 		if index == 1 {
-			buf.Write(bytes[18:37])
+			buf.Write(data[18:37])
 		} else {
-			buf.Write(bytes[(index-1)*19+18 : (index-1)*19+18+19])
+			buf.Write(data[(index-1)*19+18 : (index-1)*19+18+19])
 		}
-		b.writeDataBuffer(&buf)
+		flush()
 	}
 
 	buf.WriteByte(index)
@@ -397,74 +734,131 @@ func (b *Ble) writeMessage(msg *message.Message) {
 	if rest > 14 {
 		end = 14
 	}
-	buf.Write(bytes[(fullFragments*19)+18 : (fullFragments*19)+18+end])
-	b.writeDataBuffer(&buf)
+	buf.Write(data[(fullFragments*19)+18 : (fullFragments*19)+18+end])
+	flush()
 	if rest > 14 {
 		index++
 		buf.WriteByte(index)
 		buf.WriteByte(rest - 14)
-		buf.Write(bytes[fullFragments*19+18+14:])
+		buf.Write(data[fullFragments*19+18+14:])
 		for buf.Len() < 20 {
 			buf.WriteByte(0)
 		}
-		b.writeDataBuffer(&buf)
+		flush()
+	}
+	return ret
+}
+
+func (b *Ble) readFragment(stop chan bool, minLen int) (Packet, error) {
+	data, err := b.readData(stop)
+	if err != nil {
+		return nil, err
+	}
+	return checkFragment(data, minLen)
+}
+
+// checkFragment makes sure we can slice the first minLen bytes of a fragment
+func checkFragment(data Packet, minLen int) (Packet, error) {
+	if len(data) < minLen {
+		return nil, fmt.Errorf("%w: %d bytes, want at least %d: %s", ErrMalformedFragment, len(data), minLen, data)
 	}
-	b.expectCommand(CmdSuccess)
+	return data, nil
 }
 
-func (b *Ble) readMessage(cmd Packet) (*message.Message, error) {
+func (b *Ble) readMessage(stop chan bool, cmd Packet) (*message.Message, error) {
 	var buf bytes.Buffer
 	var checksum []byte
 
 	log.Trace("pkg bluetooth; Reading RTS")
+	if len(cmd) == 0 {
+		return nil, fmt.Errorf("%w: empty command", ErrUnexpectedCommand)
+	}
 	if !bytes.Equal(CmdRTS[:1], cmd[:1]) {
-		log.Fatalf("pkg bluetooth; expected command: %x. received command: %x", CmdRTS, cmd)
+		return nil, fmt.Errorf("%w: expected: %s. received: %s", ErrUnexpectedCommand, CmdRTS, cmd)
+	}
+	faults := b.takeFaults(false)
+	if faults.WithholdCTS {
+		log.Infof("pkg bluetooth; injected fault: not answering RTS")
+		return nil, nil
+	}
+	if reply := faults.rtsReply(); reply != nil {
+		log.Infof("pkg bluetooth; injected fault: answering RTS with %s", reply)
+		b.WriteCmd(reply)
+		return nil, nil
+	}
+	if err := sleep(stop, faults.DelayCTS); err != nil {
+		return nil, err
 	}
 	log.Trace("pkg bluetooth; Sending CTS")
 
 	b.WriteCmd(CmdCTS)
 
-	first, _ := b.ReadData()
+	first, err := b.readFragment(stop, 7)
+	if err != nil {
+		return nil, err
+	}
 	fragments := int(first[1])
 	expectedIndex := 1
 	oneExtra := false
 	if fragments == 0 {
 		checksum = first[2:6]
 		len := first[6]
-		end := len + 7
+		end := int(len) + 7
 		if len > 13 {
 			oneExtra = true
 			end = 20
 		}
+		if first, err = checkFragment(first, end); err != nil {
+			return nil, err
+		}
 		buf.Write(first[7:end])
 	} else {
+		if first, err = checkFragment(first, 20); err != nil {
+			return nil, err
+		}
 		buf.Write(first[2:20])
 	}
 	for i := 1; i < fragments; i++ {
-		data, _ := b.ReadData()
+		data, err := b.readFragment(stop, 20)
+		if err != nil {
+			return nil, err
+		}
 		if i == expectedIndex {
 			buf.Write(data[1:20])
 		} else {
 			log.Warnf("pkg bluetooth; sending NACK, packet index is wrong")
 			buf.Write(data[:])
-			CmdNACK[1] = byte(expectedIndex)
-			b.WriteCmd(CmdNACK)
+			// CmdNACK is shared by every pod, the index goes in a new packet
+			b.WriteCmd(Packet{CmdNACK[0], byte(expectedIndex)})
+			bleNacks.Inc(b.adapter, "sent")
 		}
 		expectedIndex++
 	}
 	if fragments != 0 {
-		data, _ := b.ReadData()
+		data, err := b.readFragment(stop, 6)
+		if err != nil {
+			return nil, err
+		}
 		len := data[1]
 		if len > 14 {
 			oneExtra = true
 			len = 14
 		}
 		checksum = data[2:6]
+		if data, err = checkFragment(data, int(len)+6); err != nil {
+			return nil, err
+		}
 		buf.Write(data[6 : len+6])
 	}
 	log.Tracef("pkg bluetooth; One extra: %t", oneExtra)
 	if oneExtra {
-		data, _ := b.ReadData()
+		data, err := b.readFragment(stop, 2)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = checkFragment(data, int(data[1])+2); err != nil {
+			return nil, err
+		}
 		buf.Write(data[2 : data[1]+2])
 	}
 	bytes := buf.Bytes()
@@ -472,15 +866,19 @@ func (b *Ble) readMessage(cmd Packet) (*message.Message, error) {
 	if binary.BigEndian.Uint32(checksum) != sum {
 		log.Warnf("pkg bluetooth; checksum missmatch. checksum is: %x. want: %x", sum, checksum)
 		log.Warnf("pkg bluetooth; data: %s", hex.EncodeToString(bytes))
+		bleChecksumFailures.Inc(b.adapter)
 
 		b.WriteCmd(CmdFail)
-		return nil, errors.New("checksum missmatch")
+		return nil, ErrChecksum
 	}
 
+	if err := sleep(stop, faults.DelaySuccess); err != nil {
+		return nil, err
+	}
 	b.WriteCmd(CmdSuccess)
 
 	msg, _err := message.Unmarshal(bytes)
-	log.Tracef("pkg bluetooth; Received message:", spew.Sdump(msg))
+	log.Tracef("pkg bluetooth; Received message: %s", spew.Sdump(msg))
 
 	return msg, _err
 }
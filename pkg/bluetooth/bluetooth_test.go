@@ -0,0 +1,289 @@
+package bluetooth
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/avereha/pod/pkg/message"
+)
+
+// TestSplitMessage compares the fragments with the ones the simulator sent
+// before fragmenting was split out of writeMessage
+func TestSplitMessage(t *testing.T) {
+	for _, tt := range []struct {
+		size      int
+		fragments []string
+	}{
+		{0, []string{
+			"0000aabbccdd00",
+		}},
+		{1, []string{
+			"0000aabbccdd0100",
+		}},
+		{14, []string{
+			"0000aabbccdd0e000102030405060708090a0b0c0d",
+		}},
+		{15, []string{
+			"0000aabbccdd0f000102030405060708090a0b0c0d",
+			"00010e",
+		}},
+		{18, []string{
+			"0000aabbccdd12000102030405060708090a0b0c0d",
+			"00040e0f1011",
+		}},
+		{19, []string{
+			"0001000102030405060708090a0b0c0d0e0f1011",
+			"0101aabbccdd12",
+		}},
+		{20, []string{
+			"0001000102030405060708090a0b0c0d0e0f1011",
+			"0102aabbccdd1213",
+		}},
+		{32, []string{
+			"0001000102030405060708090a0b0c0d0e0f1011",
+			"010eaabbccdd12131415161718191a1b1c1d1e1f",
+		}},
+		{33, []string{
+			"0001000102030405060708090a0b0c0d0e0f1011",
+			"010faabbccdd12131415161718191a1b1c1d1e1f",
+			"0201200000000000000000000000000000000000",
+		}},
+		{36, []string{
+			"0001000102030405060708090a0b0c0d0e0f1011",
+			"0112aabbccdd12131415161718191a1b1c1d1e1f",
+			"0204202122230000000000000000000000000000",
+		}},
+		{37, []string{
+			"0002000102030405060708090a0b0c0d0e0f1011",
+			"0112131415161718191a1b1c1d1e1f2021222324",
+			"0200aabbccdd",
+		}},
+		{38, []string{
+			"0002000102030405060708090a0b0c0d0e0f1011",
+			"0112131415161718191a1b1c1d1e1f2021222324",
+			"0201aabbccdd25",
+		}},
+		{51, []string{
+			"0002000102030405060708090a0b0c0d0e0f1011",
+			"0112131415161718191a1b1c1d1e1f2021222324",
+			"020eaabbccdd25262728292a2b2c2d2e2f303132",
+		}},
+		{52, []string{
+			"0002000102030405060708090a0b0c0d0e0f1011",
+			"0112131415161718191a1b1c1d1e1f2021222324",
+			"020faabbccdd25262728292a2b2c2d2e2f303132",
+			"0301330000000000000000000000000000000000",
+		}},
+		{55, []string{
+			"0002000102030405060708090a0b0c0d0e0f1011",
+			"0112131415161718191a1b1c1d1e1f2021222324",
+			"0212aabbccdd25262728292a2b2c2d2e2f303132",
+			"0304333435360000000000000000000000000000",
+		}},
+		{56, []string{
+			"0003000102030405060708090a0b0c0d0e0f1011",
+			"0112131415161718191a1b1c1d1e1f2021222324",
+			"0225262728292a2b2c2d2e2f3031323334353637",
+			"0300aabbccdd",
+		}},
+		{75, []string{
+			"0004000102030405060708090a0b0c0d0e0f1011",
+			"0112131415161718191a1b1c1d1e1f2021222324",
+			"0225262728292a2b2c2d2e2f3031323334353637",
+			"0338393a3b3c3d3e3f404142434445464748494a",
+			"0400aabbccdd",
+		}},
+	} {
+		data := make([]byte, tt.size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		fragments := splitMessage(data, 0xaabbccdd)
+		if len(fragments) != len(tt.fragments) {
+			t.Errorf("%d bytes: got %d fragments, want %d: %v", tt.size, len(fragments), len(tt.fragments), fragments)
+			continue
+		}
+		for i, fragment := range fragments {
+			if want := tt.fragments[i]; fragment.String() != want {
+				t.Errorf("%d bytes, fragment %d: got %s, want %s", tt.size, i, fragment, want)
+			}
+		}
+	}
+}
+
+// newTestBle answers the RTS of the pod with CTS, and then with replies
+func newTestBle(replies ...Packet) (*Ble, chan bool) {
+	b := &Ble{
+		cmdInput:   make(chan Packet, len(replies)+1),
+		cmdOutput:  make(chan Packet, 16),
+		dataOutput: make(chan Packet, 64),
+	}
+	b.cmdInput <- CmdCTS
+	for _, reply := range replies {
+		b.cmdInput <- reply
+	}
+	// give up instead of hanging when the pod waits for more replies
+	stop := make(chan bool)
+	time.AfterFunc(time.Second, func() { close(stop) })
+	return b, stop
+}
+
+// sentFragments returns the indexes of the fragments written so far
+func sentFragments(b *Ble) []int {
+	var ret []int
+	for len(b.dataOutput) > 0 {
+		ret = append(ret, int((<-b.dataOutput)[0]))
+	}
+	return ret
+}
+
+func TestBle_SendMessage(t *testing.T) {
+	nack := func(index byte) Packet { return Packet{CmdNACK[0], index} }
+	nacks := []Packet{}
+	resent := []int{0, 1, 2, 3}
+	for i := 0; i <= maxNacks; i++ {
+		nacks = append(nacks, nack(3))
+		if i < maxNacks {
+			resent = append(resent, 3)
+		}
+	}
+
+	// 60 bytes go in fragments 0 to 3
+	for _, tt := range []struct {
+		name    string
+		replies []Packet
+		err     error
+		sent    []int
+	}{
+		{"success", []Packet{CmdSuccess}, nil, []int{0, 1, 2, 3}},
+		{"nack from 2", []Packet{nack(2), CmdSuccess}, nil, []int{0, 1, 2, 3, 2, 3}},
+		{"nack from 0", []Packet{nack(0), CmdSuccess}, nil, []int{0, 1, 2, 3, 0, 1, 2, 3}},
+		{"two nacks", []Packet{nack(3), nack(1), CmdSuccess}, nil, []int{0, 1, 2, 3, 3, 1, 2, 3}},
+		{"too many nacks", nacks, ErrUnexpectedCommand, resent},
+		{"nack without index", []Packet{CmdNACK[:1]}, ErrUnexpectedCommand, []int{0, 1, 2, 3}},
+		{"fail", []Packet{CmdFail}, errTransferFailed, []int{0, 1, 2, 3}},
+		{"abort", []Packet{nack(1), CmdAbort}, ErrAborted, []int{0, 1, 2, 3, 1, 2, 3}},
+		{"unexpected", []Packet{CmdCTS}, ErrUnexpectedCommand, []int{0, 1, 2, 3}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b, stop := newTestBle(tt.replies...)
+			err := b.sendMessage(stop, make([]byte, 60), &FaultInjection{})
+			if !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+			if sent := sentFragments(b); !reflect.DeepEqual(sent, tt.sent) {
+				t.Errorf("sent fragments %v, want %v", sent, tt.sent)
+			}
+			if len(b.cmdInput) > 0 {
+				t.Errorf("%d replies were not read", len(b.cmdInput))
+			}
+		})
+	}
+}
+
+func TestBle_SendMessage_Short(t *testing.T) {
+	// messages that fit in the first fragments are answered like the others
+	b, stop := newTestBle(CmdSuccess)
+	if err := b.sendMessage(stop, make([]byte, 18), &FaultInjection{}); err != nil {
+		t.Fatal(err)
+	}
+	if sent := sentFragments(b); len(sent) != 2 {
+		t.Errorf("sent %d fragments, want 2", len(sent))
+	}
+	if len(b.cmdInput) > 0 {
+		t.Errorf("the Success was not read")
+	}
+}
+
+func TestBle_WriteMessage_ShortCorrupted(t *testing.T) {
+	msg := &message.Message{Type: message.MessageTypeEncrypted, EncryptedPayload: true, Raw: make([]byte, 10)}
+
+	// the central fails the corrupted CRC, the message is sent again without it
+	b, stop := newTestBle(CmdFail, CmdCTS, CmdSuccess)
+	b.messageFaults = &FaultInjection{CorruptCRC: true}
+	if err := b.writeMessage(stop, msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.cmdOutput) != 2 {
+		t.Errorf("sent %d RTS, want 2", len(b.cmdOutput))
+	}
+	// one fragment for each attempt
+	if sent := sentFragments(b); !reflect.DeepEqual(sent, []int{0, 0}) {
+		t.Errorf("sent fragments %v, want [0 0]", sent)
+	}
+	if len(b.cmdInput) > 0 {
+		t.Errorf("%d replies were not read", len(b.cmdInput))
+	}
+}
+
+func TestBle_SendMessage_Faults(t *testing.T) {
+	b, stop := newTestBle(Packet{CmdNACK[0], 1}, CmdSuccess)
+	faults := &FaultInjection{DropFragments: []int{1}, ReorderFragments: true}
+	if err := b.sendMessage(stop, make([]byte, 60), faults); err != nil {
+		t.Fatal(err)
+	}
+	// fragment 1 is dropped from the swapped ones, the resend is complete
+	if sent, want := sentFragments(b), []int{0, 2, 3, 1, 2, 3}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent fragments %v, want %v", sent, want)
+	}
+}
+
+func TestBle_WriteMessage_Fail(t *testing.T) {
+	msg := &message.Message{Type: message.MessageTypeEncrypted, EncryptedPayload: true, Raw: make([]byte, 60)}
+
+	b, stop := newTestBle(CmdFail, CmdCTS, CmdFail, CmdCTS, CmdSuccess)
+	if err := b.writeMessage(stop, msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.cmdOutput) != 3 {
+		t.Errorf("sent %d RTS, want 3", len(b.cmdOutput))
+	}
+
+	var replies []Packet
+	for i := 0; i < maxMessageAttempts; i++ {
+		replies = append(replies, CmdFail, CmdCTS)
+	}
+	b, stop = newTestBle(replies[:len(replies)-1]...)
+	if err := b.writeMessage(stop, msg); !errors.Is(err, errTransferFailed) {
+		t.Errorf("got error %v, want %v", err, errTransferFailed)
+	}
+	if len(b.cmdOutput) != maxMessageAttempts {
+		t.Errorf("sent %d RTS, want %d", len(b.cmdOutput), maxMessageAttempts)
+	}
+}
+
+func TestBle_Sleep(t *testing.T) {
+	if err := (&Ble{}).Sleep(time.Hour); !errors.Is(err, ErrDisconnected) {
+		t.Errorf("sleeping without a connection: got %v, want %v", err, ErrDisconnected)
+	}
+
+	b := &Ble{stopLoop: make(chan bool)}
+	if err := b.Sleep(time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(10*time.Millisecond, func() { close(b.stopLoop) })
+	start := time.Now()
+	if err := b.Sleep(time.Hour); !errors.Is(err, ErrDisconnected) || time.Since(start) > time.Second {
+		t.Errorf("a disconnect should end the sleep, got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestBle_WriteMessage(t *testing.T) {
+	msg := &message.Message{}
+	if err := (&Ble{}).WriteMessage(msg); !errors.Is(err, ErrDisconnected) {
+		t.Errorf("writing without a connection: got %v, want %v", err, ErrDisconnected)
+	}
+
+	b := &Ble{stopLoop: make(chan bool), messageOutput: make(chan *message.Message, 1)}
+	if err := b.WriteMessage(msg); err != nil || <-b.messageOutput != msg {
+		t.Fatalf("message not queued: %v", err)
+	}
+	// nobody reads the message once the central is gone
+	close(b.stopLoop)
+	b.messageOutput <- msg
+	if err := b.WriteMessage(msg); !errors.Is(err, ErrDisconnected) {
+		t.Errorf("writing after a disconnect: got %v, want %v", err, ErrDisconnected)
+	}
+}
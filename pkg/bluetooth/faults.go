@@ -0,0 +1,140 @@
+package bluetooth
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FaultInjection makes the transport misbehave on purpose, so we can see how
+// the central recovers from radio-level errors. The zero value injects nothing.
+type FaultInjection struct {
+	// Inbound messages, sent by the central
+
+	// Wait this long before answering an RTS with CTS
+	DelayCTS time.Duration
+	// Do not answer the RTS at all
+	WithholdCTS bool
+	// Answer the RTS with NACK, Abort or Fail instead of CTS
+	RTSReply string
+	// Wait this long before answering a received message with Success
+	DelaySuccess time.Duration
+
+	// Outbound messages, sent by the pod
+
+	// Indexes of the data fragments that are not sent
+	DropFragments []int
+	// Send the first two data fragments in reverse order
+	ReorderFragments bool
+	// Send a CRC32 that does not match the message
+	CorruptCRC bool
+}
+
+var rtsReplies = map[string]Packet{
+	"NACK":  CmdNACK,
+	"ABORT": CmdAbort,
+	"FAIL":  CmdFail,
+}
+
+func (f *FaultInjection) Validate() error {
+	if f.RTSReply != "" {
+		if _, ok := rtsReplies[strings.ToUpper(f.RTSReply)]; !ok {
+			return fmt.Errorf("unknown RTS reply %q. Use one of: NACK, Abort, Fail", f.RTSReply)
+		}
+	}
+	if f.WithholdCTS && f.RTSReply != "" {
+		return fmt.Errorf("cannot withhold CTS and reply %s at the same time", f.RTSReply)
+	}
+	if f.DelayCTS < 0 || f.DelaySuccess < 0 {
+		return fmt.Errorf("fault injection delays can not be negative")
+	}
+	return nil
+}
+
+func (f *FaultInjection) inbound() bool {
+	return f.DelayCTS > 0 || f.WithholdCTS || f.RTSReply != "" || f.DelaySuccess > 0
+}
+
+func (f *FaultInjection) outbound() bool {
+	return len(f.DropFragments) > 0 || f.ReorderFragments || f.CorruptCRC
+}
+
+func (f *FaultInjection) rtsReply() Packet {
+	reply := rtsReplies[strings.ToUpper(f.RTSReply)]
+	if reply == nil {
+		return nil
+	}
+	// copy, so the NACK index can be set without touching CmdNACK
+	ret := make(Packet, len(reply))
+	copy(ret, reply)
+	return ret
+}
+
+func (f *FaultInjection) dropFragment(index int) bool {
+	for _, i := range f.DropFragments {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+// InjectFaults makes the transport misbehave. With perMessage the faults
+// apply to the next message they are relevant for, otherwise they stay
+// until the central disconnects or ClearFaults is called.
+func (b *Ble) InjectFaults(f FaultInjection, perMessage bool) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	log.Infof("pkg bluetooth; injecting faults, per message: %t: %+v", perMessage, f)
+	b.faultsMtx.Lock()
+	defer b.faultsMtx.Unlock()
+	if perMessage {
+		b.messageFaults = &f
+	} else {
+		b.sessionFaults = &f
+	}
+	return nil
+}
+
+func (b *Ble) ClearFaults() {
+	b.faultsMtx.Lock()
+	defer b.faultsMtx.Unlock()
+	b.sessionFaults = nil
+	b.messageFaults = nil
+}
+
+// takeFaults returns the faults to inject in the next inbound or outbound
+// message. Per message faults are used up by this call.
+func (b *Ble) takeFaults(outbound bool) *FaultInjection {
+	b.faultsMtx.Lock()
+	defer b.faultsMtx.Unlock()
+
+	f := b.messageFaults
+	if f != nil && ((outbound && f.outbound()) || (!outbound && f.inbound())) {
+		b.messageFaults = nil
+		log.Infof("pkg bluetooth; injecting faults in this message: %+v", *f)
+		return f
+	}
+	if b.sessionFaults != nil {
+		return b.sessionFaults
+	}
+	return &FaultInjection{}
+}
+
+// sleep waits for d, or until the loop is stopped
+func sleep(stop chan bool, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-stop:
+		return ErrDisconnected
+	}
+}
@@ -0,0 +1,53 @@
+package bluetooth
+
+import (
+	"testing"
+)
+
+func TestBle_TakeFaults(t *testing.T) {
+	b := &Ble{}
+	if f := b.takeFaults(true); f.inbound() || f.outbound() {
+		t.Fatalf("no faults injected, got %+v", f)
+	}
+
+	session := FaultInjection{DropFragments: []int{1}}
+	if err := b.InjectFaults(session, false); err != nil {
+		t.Fatal(err)
+	}
+	perMessage := FaultInjection{CorruptCRC: true, DelayCTS: 1}
+	if err := b.InjectFaults(perMessage, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// an inbound message uses up the faults, they have an inbound part
+	if f := b.takeFaults(false); f.DelayCTS != 1 || !f.CorruptCRC {
+		t.Errorf("first inbound message: got %+v, want the per message faults", f)
+	}
+	for i := 0; i < 2; i++ {
+		if f := b.takeFaults(true); !f.dropFragment(1) || f.CorruptCRC {
+			t.Errorf("outbound message %d: got %+v, want the session faults", i, f)
+		}
+	}
+
+	// per message faults wait for a message they apply to
+	if err := b.InjectFaults(FaultInjection{ReorderFragments: true}, true); err != nil {
+		t.Fatal(err)
+	}
+	if f := b.takeFaults(false); f.ReorderFragments {
+		t.Errorf("inbound message got the outbound faults: %+v", f)
+	}
+	if f := b.takeFaults(true); !f.ReorderFragments {
+		t.Errorf("outbound message: got %+v, want the per message faults", f)
+	}
+	if f := b.takeFaults(true); f.ReorderFragments || !f.dropFragment(1) {
+		t.Errorf("per message faults were not used up: %+v", f)
+	}
+
+	b.ClearFaults()
+	if f := b.takeFaults(true); f.outbound() {
+		t.Errorf("faults were not cleared: %+v", f)
+	}
+	if err := b.InjectFaults(FaultInjection{RTSReply: "maybe"}, false); err == nil {
+		t.Errorf("invalid faults should be refused")
+	}
+}
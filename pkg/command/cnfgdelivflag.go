@@ -1,19 +1,49 @@
 package command
 
 import (
+	"fmt"
+
 	"github.com/avereha/pod/pkg/response"
 	log "github.com/sirupsen/logrus"
 )
 
+// DeliveryFlags are the two bytes of 0x08. They are written to entries $16
+// and $17 of table 5 of the firmware. Loop calls the command
+// FaultConfigCommand and sends both zero during activation, before priming.
+type DeliveryFlags struct {
+	Tab5Sub16 uint8 `toml:"tab5_16"` // 0 turns the 0x6x faults off
+	Tab5Sub17 uint8 `toml:"tab5_17"`
+}
+
+// Faults6xEnabled reports whether the pod can still raise the 0x6x faults
+func (f DeliveryFlags) Faults6xEnabled() bool {
+	return f.Tab5Sub16 != 0
+}
+
+func (f DeliveryFlags) String() string {
+	return fmt.Sprintf("tab5[$16] = %d, tab5[$17] = %d", f.Tab5Sub16, f.Tab5Sub17)
+}
+
+// CnfgDelivFlag sets the delivery flags, the apps send it during activation
 type CnfgDelivFlag struct {
-	Seq uint8
-	ID  []byte
+	Seq   uint8
+	ID    []byte
+	Flags DeliveryFlags
 }
 
 func UnmarshalCnfgDelivFlag(data []byte) (*CnfgDelivFlag, error) {
 	ret := &CnfgDelivFlag{}
-	// TODO deserialize this command
 	log.Debugf("CnfgDelivFlag, 0x08, received, data %x", data)
+
+	// 08 06 NNNNNNNN JJ KK
+	//    00 01020304 05 06
+	if len(data) < 7 {
+		return nil, fmt.Errorf("invalid length when unmarshaling CnfgDelivFlag %x", data)
+	}
+	ret.Flags = DeliveryFlags{
+		Tab5Sub16: data[5],
+		Tab5Sub17: data[6],
+	}
 	return ret, nil
 }
 
@@ -22,7 +52,7 @@ func (g *CnfgDelivFlag) GetSeq() uint8 {
 }
 
 func (g *CnfgDelivFlag) IsResponseHardcoded() bool {
-	return true
+	return false
 }
 
 func (g *CnfgDelivFlag) DoesMutatePodState() bool {
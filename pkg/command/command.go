@@ -62,8 +62,10 @@ type CommandReader struct {
 	Data []byte // keep it simple for now
 }
 
-func Unmarshal(data []byte) (Command, error) {
-	var err error
+// Unmarshal decodes a message body. The body can carry several commands,
+// like a 0x19 and a 0x1f, or a 0x1a and a 0x1e; they are returned in order
+// and share the sequence number and the request ID of the message.
+func Unmarshal(data []byte) ([]Command, error) {
 	if len(data) < 10 {
 		return nil, fmt.Errorf("pkg command; command is too short: %x", data)
 	}
@@ -95,43 +97,72 @@ func Unmarshal(data []byte) (Command, error) {
 	}
 	crc := data[n-2:]
 	log.Tracef("pkg command; CRC = %x", crc)
-	t := Type(data[6])
-	log.Infof("pkg command; 0x%2.2x; %s; HEX, %x", t, CommandName[t], data)
 
-	data = data[7 : n-2]
-	var ret Command
+	var ret []Command
+	body := data[6 : n-2]
+	for len(body) > 0 {
+		// TT LL followed by LL bytes
+		if len(body) < 2 || int(body[1])+2 > len(body) {
+			return nil, fmt.Errorf("pkg command; truncated command in message body: %x", body)
+		}
+		t := Type(body[0])
+		block := body[:int(body[1])+2]
+		body = body[len(block):]
+		log.Infof("pkg command; 0x%2.2x; %s; HEX, %x", t, CommandName[t], block)
+
+		switch t {
+		case PROGRAM_BASAL, PROGRAM_TEMP_BASAL, PROGRAM_BOLUS:
+			// the second half of the 0x1a before it
+			var insulin *ProgramInsulin
+			if len(ret) > 0 {
+				insulin, _ = ret[len(ret)-1].(*ProgramInsulin)
+			}
+			if insulin == nil || insulin.Program != 0 {
+				return nil, fmt.Errorf("pkg command; 0x%2.2x without 0x1a before it: %x", t, data)
+			}
+			insulin.Program = t
+			continue
+		}
+
+		cmd, err := unmarshalCommand(t, block[1:])
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.SetHeaderData(seq, id); err != nil {
+			return nil, err
+		}
+		ret = append(ret, cmd)
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("pkg command; no command in message body: %x", data)
+	}
+	return ret, nil
+}
 
+// unmarshalCommand decodes one command of type t, data starts at its length
+func unmarshalCommand(t Type, data []byte) (Command, error) {
 	switch t {
 	case GET_VERSION:
-		ret, err = UnmarshalGetVersion(data)
+		return UnmarshalGetVersion(data)
 	case SET_UNIQUE_ID:
-		ret, err = UnmarshalSetUniqueID(data)
+		return UnmarshalSetUniqueID(data)
 	case PROGRAM_ALERTS:
-		ret, err = UnmarshalProgramAlerts(data)
+		return UnmarshalProgramAlerts(data)
 	case PROGRAM_INSULIN:
-		ret, err = UnmarshalProgramInsulin(data)
+		return UnmarshalProgramInsulin(data)
 	case GET_STATUS:
-		ret, err = UnmarshalGetStatus(data)
+		return UnmarshalGetStatus(data)
 	case SILENCE_ALERTS:
-		ret, err = UnmarshalSilenceAlerts(data)
+		return UnmarshalSilenceAlerts(data)
 	case DEACTIVATE:
-		ret, err = UnmarshalDeactivate(data)
+		return UnmarshalDeactivate(data)
 	case PROGRAM_BEEPS:
-		ret, err = UnmarshalProgramBeeps(data)
+		return UnmarshalProgramBeeps(data)
 	case STOP_DELIVERY:
-		ret, err = UnmarshalStopDelivery(data)
+		return UnmarshalStopDelivery(data)
 	case CNFG_DELIV_FLAG:
-		ret, err = UnmarshalCnfgDelivFlag(data)
+		return UnmarshalCnfgDelivFlag(data)
 	default:
-		ret, err = UnmarshalNack(data)
+		return UnmarshalNack(data)
 	}
-
-	if err != nil {
-		return nil, err
-	}
-	if err := ret.SetHeaderData(seq, id); err != nil {
-		return nil, err
-	}
-
-	return ret, nil
 }
@@ -0,0 +1,76 @@
+package command
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// message wraps a hex message body the way it comes out of the message layer
+func message(t *testing.T, body string) []byte {
+	b, err := hex.DecodeString(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte{0x17, 0x13, 0x9b, 0x1f, 0x0c, byte(len(b))} // id, seq 3
+	data = append(data, b...)
+	data = append(data, 0x00, 0x00) // crc
+	ret := []byte("S0.0=")
+	ret = append(ret, byte(len(data)>>8), byte(len(data)))
+	ret = append(ret, data...)
+	return append(ret, ",G0.0"...)
+}
+
+func TestUnmarshal_SeveralCommands(t *testing.T) {
+	// low reservoir and expiration alerts, then stop all deliveries
+	cmds, err := Unmarshal(message(t, "190a494e532e4c0000640102"+"1f05494e532e37"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) != 2 || cmds[0].GetType() != PROGRAM_ALERTS || cmds[1].GetType() != STOP_DELIVERY {
+		t.Fatalf("unexpected commands: %+v", cmds)
+	}
+	for _, c := range cmds {
+		if c.GetSeq() != 3 {
+			t.Errorf("0x%2.2x: got seq %d, want 3", c.GetType(), c.GetSeq())
+		}
+	}
+}
+
+func TestUnmarshal_ProgramInsulin(t *testing.T) {
+	// 0.5U bolus, the 0x17 belongs to the 0x1a
+	cmds, err := Unmarshal(message(t, "1a0e494e532e02010a01010a000a000a"+"170d00006400030d40000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) != 1 {
+		t.Fatalf("got %d commands, want 1", len(cmds))
+	}
+	c, ok := cmds[0].(*ProgramInsulin)
+	if !ok || c.Program != PROGRAM_BOLUS || c.Pulses != 10 {
+		t.Errorf("unexpected command: %+v", cmds[0])
+	}
+
+	if _, err := Unmarshal(message(t, "170d00006400030d40000000000000")); err == nil {
+		t.Errorf("0x17 without 0x1a should fail")
+	}
+	if _, err := Unmarshal(message(t, "1f05494e532e")); err == nil {
+		t.Errorf("truncated command should fail")
+	}
+}
+
+func TestUnmarshal_CnfgDelivFlag(t *testing.T) {
+	cmds, err := Unmarshal(message(t, "0806494e532e0001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := cmds[0].(*CnfgDelivFlag)
+	if !ok || c.Flags != (DeliveryFlags{Tab5Sub16: 0, Tab5Sub17: 1}) {
+		t.Fatalf("unexpected command: %+v", cmds[0])
+	}
+	if c.Flags.Faults6xEnabled() {
+		t.Errorf("a zero tab5[$16] turns the 0x6x faults off")
+	}
+	if _, err := Unmarshal(message(t, "0805494e532e00")); err == nil {
+		t.Errorf("truncated 0x08 should fail")
+	}
+}
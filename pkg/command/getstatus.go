@@ -1,6 +1,8 @@
 package command
 
 import (
+	"fmt"
+
 	"github.com/avereha/pod/pkg/response"
 	log "github.com/sirupsen/logrus"
 )
@@ -12,6 +14,9 @@ type GetStatus struct {
 }
 
 func UnmarshalGetStatus(data []byte) (*GetStatus, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("invalid length when unmarshaling GetStatus %x", data)
+	}
 	ret := &GetStatus{}
 
 	ret.RequestType = data[1]
@@ -14,7 +14,7 @@ type GetVersion struct {
 }
 
 func UnmarshalGetVersion(data []byte) (*GetVersion, error) {
-	if data[0] != 4 {
+	if len(data) < 5 || data[0] != 4 {
 		return nil, fmt.Errorf("invalid length when unmarshaling GetVersion %d :: %x", data[0], data)
 	}
 	ret := &GetVersion{}
@@ -38,7 +38,7 @@ func (g *GetVersion) DoesMutatePodState() bool {
 
 func (g *GetVersion) GetResponse() (response.Response, error) {
 	// TODO improve responses
-	return &response.VersionResponse{}, nil
+	return &response.VersionResponse{PodProgress: response.PodProgressReminderInitialized}, nil
 }
 
 func (g *GetVersion) SetHeaderData(seq uint8, id []byte) error {
@@ -1,19 +1,57 @@
 package command
 
 import (
+	"encoding/binary"
+	"fmt"
+
 	"github.com/avereha/pod/pkg/response"
 	log "github.com/sirupsen/logrus"
 )
 
+// AlertConfig is one alert slot programmed with 0x19
+type AlertConfig struct {
+	Slot   uint8
+	Active bool
+	// The alert fires when the reservoir gets below Trigger pulses instead
+	// of Trigger minutes after the command
+	ReservoirTrigger bool
+	AutoOff          bool
+	Duration         uint16 // minutes the alert stays active, 0 until silenced
+	Trigger          uint16
+	BeepRepeat       uint8
+	BeepType         BeepType
+}
+
 type ProgramAlerts struct {
-	Seq uint8
-	ID  []byte
+	Seq    uint8
+	ID     []byte
+	Alerts []AlertConfig
 }
 
 func UnmarshalProgramAlerts(data []byte) (*ProgramAlerts, error) {
 	ret := &ProgramAlerts{}
-	// TODO deserialize this command
 	log.Debugf("ProgramAlerts, 0x19, received, data %x", data)
+
+	// 19 LL NNNNNNNN IVXX YYYY 0J0K [IVXX YYYY 0J0K]...
+	//    00 01020304 0506 0708 0910
+	// I: slot in bits 4-6, active bit 3, reservoir trigger bit 2, auto-off bit 1
+	// VXX: duration in minutes, YYYY: trigger, J: beep repeat, K: beep type
+	if len(data) < 5 || int(data[0])+1 > len(data) || (int(data[0])-4)%6 != 0 {
+		return nil, fmt.Errorf("invalid length when unmarshaling ProgramAlerts %x", data)
+	}
+	for i := 5; i+6 <= int(data[0])+1; i += 6 {
+		a := data[i : i+6]
+		ret.Alerts = append(ret.Alerts, AlertConfig{
+			Slot:             (a[0] >> 4) & 0b111,
+			Active:           a[0]&(1<<3) != 0,
+			ReservoirTrigger: a[0]&(1<<2) != 0,
+			AutoOff:          a[0]&(1<<1) != 0,
+			Duration:         uint16(a[0]&0b1)<<8 | uint16(a[1]),
+			Trigger:          binary.BigEndian.Uint16(a[2:4]),
+			BeepRepeat:       a[4],
+			BeepType:         BeepType(a[5]),
+		})
+	}
 	return ret, nil
 }
 
@@ -0,0 +1,41 @@
+package command
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestUnmarshalProgramAlerts(t *testing.T) {
+	// suspend in progress in 15 minutes, suspend ended in 30 minutes
+	data, _ := hex.DecodeString("10494e532e5800000f03036800001e0603")
+	c, err := UnmarshalProgramAlerts(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []AlertConfig{
+		{Slot: 5, Active: true, Trigger: 15, BeepRepeat: 3, BeepType: BeepBipBip},
+		{Slot: 6, Active: true, Trigger: 30, BeepRepeat: 6, BeepType: BeepBipBip},
+	}
+	if len(c.Alerts) != len(want) {
+		t.Fatalf("got %d alerts, want %d", len(c.Alerts), len(want))
+	}
+	for i := range want {
+		if c.Alerts[i] != want[i] {
+			t.Errorf("alert %d: got %+v, want %+v", i, c.Alerts[i], want[i])
+		}
+	}
+	if _, err := UnmarshalProgramAlerts(data[:12]); err == nil {
+		t.Errorf("short command should fail")
+	}
+}
+
+func TestUnmarshalStopDelivery(t *testing.T) {
+	data, _ := hex.DecodeString("05494e532e37")
+	c, err := UnmarshalStopDelivery(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.BeepType != BeepBipBip || !c.StopsAll() || c.Nonce != 0x494e532e {
+		t.Errorf("unexpected stop delivery: %+v", c)
+	}
+}
@@ -1,19 +1,85 @@
 package command
 
 import (
+	"fmt"
+
 	"github.com/avereha/pod/pkg/response"
 	log "github.com/sirupsen/logrus"
 )
 
+// BeepType is the sound the pod makes
+type BeepType uint8
+
+const (
+	BeepNone                     BeepType = 0x0
+	BeepBeeeeeep                 BeepType = 0x1
+	BeepBipBeepBipBeepBipBeepBip BeepType = 0x2
+	BeepBipBip                   BeepType = 0x3
+	BeepBeep                     BeepType = 0x4
+	BeepBeepBeepBeep             BeepType = 0x5
+	BeepBeeeep                   BeepType = 0x6
+	BeepBipBipBipBipBipBip       BeepType = 0x7
+	BeepBeeeeeepBeeeeeep         BeepType = 0x8
+	BeepNoneKeepCurrent          BeepType = 0xf // 0x1e does not change the current beeps
+)
+
+var beepNames = map[BeepType]string{
+	BeepNone:                     "none",
+	BeepBeeeeeep:                 "beeeeeep",
+	BeepBipBeepBipBeepBipBeepBip: "bip-beep x4",
+	BeepBipBip:                   "bip-bip",
+	BeepBeep:                     "beep",
+	BeepBeepBeepBeep:             "beep x4",
+	BeepBeeeep:                   "beeeep",
+	BeepBipBipBipBipBipBip:       "bip x6",
+	BeepBeeeeeepBeeeeeep:         "beeeeeep x2",
+	BeepNoneKeepCurrent:          "none, keep current",
+}
+
+func (b BeepType) String() string {
+	if name, ok := beepNames[b]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", uint8(b))
+}
+
+// DeliveryBeeps are the beeps programmed for one kind of delivery
+type DeliveryBeeps struct {
+	Completion bool  `toml:"completion"` // beep when the delivery ends
+	Interval   uint8 `toml:"interval"`   // minutes between beeps while it runs, 0 for none
+}
+
+func decodeDeliveryBeeps(b byte) DeliveryBeeps {
+	return DeliveryBeeps{
+		Completion: b&(1<<6) != 0,
+		Interval:   b & 0x3f,
+	}
+}
+
 type ProgramBeeps struct {
 	Seq uint8
 	ID  []byte
+
+	BeepType  BeepType // played now
+	Basal     DeliveryBeeps
+	TempBasal DeliveryBeeps
+	Bolus     DeliveryBeeps
 }
 
 func UnmarshalProgramBeeps(data []byte) (*ProgramBeeps, error) {
 	ret := &ProgramBeeps{}
-	// TODO deserialize this command
 	log.Debugf("ProgramBeeps, 0x1e, received, data %x", data)
+
+	// 1e 04 0T BA TB BO
+	//    00 01 02 03 04
+	// BA, TB, BO: completion beep in bit 6, interval in minutes in bits 0-5
+	if len(data) < 5 {
+		return nil, fmt.Errorf("invalid length when unmarshaling ProgramBeeps %x", data)
+	}
+	ret.BeepType = BeepType(data[1] & 0x0f)
+	ret.Basal = decodeDeliveryBeeps(data[2])
+	ret.TempBasal = decodeDeliveryBeeps(data[3])
+	ret.Bolus = decodeDeliveryBeeps(data[4])
 	return ret, nil
 }
 
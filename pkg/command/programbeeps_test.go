@@ -0,0 +1,24 @@
+package command
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestUnmarshalProgramBeeps(t *testing.T) {
+	// bip-bip now, bolus completion beep, temp basal beeps every 15 minutes
+	data, _ := hex.DecodeString("0403000f40")
+	c, err := UnmarshalProgramBeeps(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.BeepType != BeepBipBip {
+		t.Errorf("beep type %s", c.BeepType)
+	}
+	if c.Basal != (DeliveryBeeps{}) || c.TempBasal != (DeliveryBeeps{Interval: 15}) || c.Bolus != (DeliveryBeeps{Completion: true}) {
+		t.Errorf("unexpected delivery beeps: %+v", c)
+	}
+	if _, err := UnmarshalProgramBeeps(data[:4]); err == nil {
+		t.Errorf("short command should fail")
+	}
+}
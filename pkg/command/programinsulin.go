@@ -1,6 +1,8 @@
 package command
 
 import (
+	"fmt"
+
 	"github.com/avereha/pod/pkg/response"
 	log "github.com/sirupsen/logrus"
 )
@@ -10,7 +12,12 @@ type ProgramInsulin struct {
 	ID       []byte
 	TableNum byte
 	Pulses   uint16
-	Duration uint8 // Number of half hour increments
+	Duration uint8 // Number of half hour increments. For basal schedules: the current half hour segment
+
+	SecondsRemaining uint16   // Seconds left in the current half hour segment
+	Schedule         []uint16 // Pulses for each half hour segment, expanded from the schedule entries
+
+	Program Type // the 0x13, 0x16 or 0x17 that came with the 0x1a
 }
 
 func UnmarshalProgramInsulin(data []byte) (*ProgramInsulin, error) {
@@ -20,12 +27,37 @@ func UnmarshalProgramInsulin(data []byte) (*ProgramInsulin, error) {
 
 	// 1a LL NNNNNNNN 02 CCCC HH SSSS PPPP 0ppp
 	//    00 01020304 05 0607 08 0910 1112 1314
+	if len(data) < 13 || int(data[0])+1 > len(data) {
+		return nil, fmt.Errorf("invalid length when unmarshaling ProgramInsulin %x", data)
+	}
 	ret.TableNum = data[5]
 	ret.Duration = data[8]
+	ret.SecondsRemaining = ((uint16(data[9]) << 8) + uint16(data[10])) / 8
 	ret.Pulses = (uint16(data[11]) << 8) + uint16(data[12])
+	ret.Schedule = decodeInsulinSchedule(data[13 : int(data[0])+1])
 	return ret, nil
 }
 
+// decodeInsulinSchedule expands the napp schedule entries of a 0x1a command,
+// nnnn a0pp pppppppp in bits: n+1 half hour segments of p pulses each, with
+// one extra pulse on every other segment when the a bit is set.
+func decodeInsulinSchedule(data []byte) []uint16 {
+	var ret []uint16
+	for i := 0; i+1 < len(data); i += 2 {
+		entry := uint16(data[i])<<8 | uint16(data[i+1])
+		segments := int(entry>>12) + 1
+		pulses := entry & 0x3ff
+		for s := 0; s < segments; s++ {
+			if entry&0x800 != 0 && s%2 == 1 {
+				ret = append(ret, pulses+1)
+			} else {
+				ret = append(ret, pulses)
+			}
+		}
+	}
+	return ret
+}
+
 func (g *ProgramInsulin) GetSeq() uint8 {
 	return g.Seq
 }
@@ -0,0 +1,16 @@
+package command
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeInsulinSchedule(t *testing.T) {
+	// 3 segments of 1 pulse with an extra pulse every other segment, then
+	// 2 segments of 0x3ff pulses; bit 10 is not part of the pulses
+	got := decodeInsulinSchedule([]byte{0x28, 0x01, 0x17, 0xff})
+	want := []uint16{1, 2, 1, 0x3ff, 0x3ff}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
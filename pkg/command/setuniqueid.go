@@ -1,6 +1,8 @@
 package command
 
 import (
+	"fmt"
+
 	"github.com/avereha/pod/pkg/response"
 	log "github.com/sirupsen/logrus"
 )
@@ -12,6 +14,9 @@ type SetUniqueID struct {
 }
 
 func UnmarshalSetUniqueID(data []byte) (*SetUniqueID, error) {
+	if len(data) < 5 {
+		return nil, fmt.Errorf("invalid length when unmarshaling SetUniqueID %x", data)
+	}
 	ret := &SetUniqueID{}
 	// TODO deserialize this command
 	log.Debugf("SetUniqueID, 0x03, received, data %x", data)
@@ -35,7 +40,7 @@ func (g *SetUniqueID) DoesMutatePodState() bool {
 
 func (g *SetUniqueID) GetResponse() (response.Response, error) {
 	// TODO improve responses
-	return &response.SetUniqueID{}, nil
+	return &response.SetUniqueID{PodProgress: response.PodProgressPairingCompleted}, nil
 }
 
 func (g *SetUniqueID) SetHeaderData(seq uint8, id []byte) error {
@@ -1,6 +1,8 @@
 package command
 
 import (
+	"fmt"
+
 	"github.com/avereha/pod/pkg/response"
 	log "github.com/sirupsen/logrus"
 )
@@ -12,6 +14,9 @@ type SilenceAlerts struct {
 }
 
 func UnmarshalSilenceAlerts(data []byte) (*SilenceAlerts, error) {
+	if len(data) < 6 {
+		return nil, fmt.Errorf("invalid length when unmarshaling SilenceAlerts %x", data)
+	}
 	ret := &SilenceAlerts{}
 	ret.AlertMask = data[5]
 	log.Debugf("SilenceAlerts, 0x11, received, alert mask %x", ret.AlertMask)
@@ -1,6 +1,9 @@
 package command
 
 import (
+	"encoding/binary"
+	"fmt"
+
 	"github.com/avereha/pod/pkg/response"
 	log "github.com/sirupsen/logrus"
 )
@@ -8,22 +11,36 @@ import (
 type StopDelivery struct {
 	Seq           uint8
 	ID            []byte
+	Nonce         uint32 // not checked by the simulator
+	BeepType      BeepType
 	StopBolus     bool
 	StopTempBasal bool
 	StopBasal     bool
 }
 
 func UnmarshalStopDelivery(data []byte) (*StopDelivery, error) {
+	// 1f 05 NNNNNNNN AX
+	//    00 01020304 05
+	// A: beep type, X: deliveries to stop, bolus 0b100, temp basal 0b10, basal 0b1
+	if len(data) < 6 {
+		return nil, fmt.Errorf("invalid length when unmarshaling StopDelivery %x", data)
+	}
 	ret := &StopDelivery{
+		Nonce:         binary.BigEndian.Uint32(data[1:5]),
+		BeepType:      BeepType(data[5] >> 4),
 		StopBolus:     (data[5] & 0b100) != 0,
 		StopTempBasal: (data[5] & 0b10) != 0,
 		StopBasal:     (data[5] & 0b1) != 0,
 	}
-	// 05 49 4e 53 2e 07 1910494e532e580f000f06046800001e0302
-	log.Debugf("StopDelivery, 0x1f, received, data %x, stop_bits = %x", data, data[5]&0b1)
+	log.Debugf("StopDelivery, 0x1f, received, data %x, beep: %s, stop_bits = %03b", data, ret.BeepType, data[5]&0b111)
 	return ret, nil
 }
 
+// StopsAll reports whether the command suspends the pod
+func (g *StopDelivery) StopsAll() bool {
+	return g.StopBolus && g.StopTempBasal && g.StopBasal
+}
+
 func (g *StopDelivery) GetSeq() uint8 {
 	return g.Seq
 }
@@ -0,0 +1,233 @@
+// Package config reads the simulator configuration file. It uses TOML, like
+// the pod state. Anything left out of the file keeps its default value.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	toml "github.com/pelletier/go-toml"
+
+	"github.com/avereha/pod/pkg/response"
+)
+
+type Config struct {
+	State   string `toml:"state"`
+	Adapter string `toml:"adapter"`
+	APIPort int    `toml:"api_port"`
+	// Web pages on other hosts that may use the API, like the frontend
+	APIOrigins []string `toml:"api_origins,omitempty"`
+
+	AdvertisedName        string  `toml:"advertised_name"`
+	AdvertisingIntervalMs float64 `toml:"advertising_interval_ms"`
+
+	InitialReservoir float32 `toml:"initial_reservoir"` // units, for a fresh pod
+
+	// Rules loaded at startup, see pod.Scenario
+	Scenario string `toml:"scenario,omitempty"`
+
+	DisconnectPolicy string `toml:"disconnect_policy"`
+	DisconnectAfter  string `toml:"disconnect_after"` // idle timeout, or interval
+
+	Version Version `toml:"version"`
+
+	// Pods run several pods in one process, each on its own adapter. The
+	// settings above are the defaults for all of them.
+	Pods []Pod `toml:"pod,omitempty"`
+}
+
+// Pod overrides the settings for one of several pods. Empty fields keep the
+// top level value.
+type Pod struct {
+	Adapter        string `toml:"adapter"`
+	State          string `toml:"state"`
+	APIPort        int    `toml:"api_port,omitempty"`
+	AdvertisedName string `toml:"advertised_name,omitempty"`
+	Tid            uint32 `toml:"tid,omitempty"`
+}
+
+// Version is reported by the pod in the version responses. The lot and TID
+// are also advertised
+type Version struct {
+	PM        string `toml:"pm"`
+	PI        string `toml:"pi"`
+	ProductID uint8  `toml:"product_id"`
+	Lot       uint32 `toml:"lot"`
+	Tid       uint32 `toml:"tid"`
+}
+
+var floatKeys = []string{"advertising_interval_ms", "initial_reservoir"}
+
+func Default() *Config {
+	return &Config{
+		State:                 "state.toml",
+		Adapter:               "hci0",
+		APIPort:               8080,
+		AdvertisedName:        " :: Fake POD ::",
+		AdvertisingIntervalMs: 152.5,
+		InitialReservoir:      150,
+		DisconnectPolicy:      "idle",
+		DisconnectAfter:       "1m",
+		Version: Version{
+			PM:        "4.10.0",
+			PI:        "1.3.0",
+			ProductID: response.DefaultPodVersion.ProductID,
+			Lot:       response.DefaultPodVersion.Lot,
+			Tid:       response.DefaultPodVersion.Tid,
+		},
+	}
+}
+
+// Load reads filename on top of the defaults
+func Load(filename string) (*Config, error) {
+	ret := Default()
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse config file %s: %w", filename, err)
+	}
+	// go-toml does not turn integers into floats, "150" is as good as "150.0"
+	for _, key := range floatKeys {
+		if v, ok := tree.Get(key).(int64); ok {
+			tree.Set(key, float64(v))
+		}
+	}
+	if err := tree.Unmarshal(ret); err != nil {
+		return nil, fmt.Errorf("could not parse config file %s: %w", filename, err)
+	}
+	if err := ret.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", filename, err)
+	}
+	return ret, nil
+}
+
+// Instances returns the configuration of every pod to run
+func (c *Config) Instances() []*Config {
+	if len(c.Pods) == 0 {
+		return []*Config{c}
+	}
+	var ret []*Config
+	for _, p := range c.Pods {
+		instance := *c
+		instance.Pods = nil
+		instance.Adapter = p.Adapter
+		instance.State = p.State
+		if p.APIPort != 0 {
+			instance.APIPort = p.APIPort
+		}
+		if p.AdvertisedName != "" {
+			instance.AdvertisedName = p.AdvertisedName
+		}
+		if p.Tid != 0 {
+			instance.Version.Tid = p.Tid
+		}
+		ret = append(ret, &instance)
+	}
+	return ret
+}
+
+func (c *Config) Validate() error {
+	if len(c.Pods) > 0 {
+		return c.validatePods()
+	}
+	if c.APIPort <= 0 || c.APIPort > 65535 {
+		return fmt.Errorf("invalid API port %d", c.APIPort)
+	}
+	if c.InitialReservoir < 0 || c.InitialReservoir > 200 {
+		return fmt.Errorf("initial reservoir %.2fU is out of range", c.InitialReservoir)
+	}
+	// the controller accepts 20ms to 10.24s, in 0.625ms units
+	if c.AdvertisingIntervalMs < 20 || c.AdvertisingIntervalMs > 10240 {
+		return fmt.Errorf("advertising interval %.3fms is out of range", c.AdvertisingIntervalMs)
+	}
+	if _, err := c.DisconnectAfterDuration(); err != nil {
+		return err
+	}
+	if _, err := c.PodVersion(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validatePods checks that the pods do not share an adapter, a state file or
+// an API port
+func (c *Config) validatePods() error {
+	adapters := make(map[string]bool)
+	states := make(map[string]bool)
+	ports := make(map[int]bool)
+	for i, instance := range c.Instances() {
+		if instance.Adapter == "" || instance.State == "" {
+			return fmt.Errorf("pod %d needs an adapter and a state file", i+1)
+		}
+		if adapters[instance.Adapter] || states[instance.State] || ports[instance.APIPort] {
+			return fmt.Errorf("pod %d uses the adapter, state file or API port of another pod", i+1)
+		}
+		adapters[instance.Adapter] = true
+		states[instance.State] = true
+		ports[instance.APIPort] = true
+		if err := instance.Validate(); err != nil {
+			return fmt.Errorf("pod %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) AdvertisingInterval() time.Duration {
+	return time.Duration(c.AdvertisingIntervalMs * float64(time.Millisecond))
+}
+
+func (c *Config) DisconnectAfterDuration() (time.Duration, error) {
+	d, err := time.ParseDuration(c.DisconnectAfter)
+	if err != nil {
+		return 0, fmt.Errorf("invalid disconnect_after %q: %w", c.DisconnectAfter, err)
+	}
+	return d, nil
+}
+
+func (c *Config) PodVersion() (response.PodVersion, error) {
+	ret := response.PodVersion{
+		ProductID: c.Version.ProductID,
+		Lot:       c.Version.Lot,
+		Tid:       c.Version.Tid,
+	}
+	var err error
+	if ret.PM, err = parseVersion(c.Version.PM); err != nil {
+		return ret, fmt.Errorf("invalid pm version: %w", err)
+	}
+	if ret.PI, err = parseVersion(c.Version.PI); err != nil {
+		return ret, fmt.Errorf("invalid pi version: %w", err)
+	}
+	return ret, nil
+}
+
+// parseVersion reads "x.y.z", each part fits in a byte
+func parseVersion(s string) ([3]byte, error) {
+	var ret [3]byte
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return ret, fmt.Errorf("%q is not x.y.z", s)
+	}
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return ret, fmt.Errorf("%q is not x.y.z: %w", s, err)
+		}
+		ret[i] = byte(n)
+	}
+	return ret, nil
+}
+
+// String is the effective configuration, in the config file format
+func (c *Config) String() string {
+	data, err := toml.Marshal(c)
+	if err != nil {
+		return fmt.Sprintf("%+v", *c)
+	}
+	return string(data)
+}
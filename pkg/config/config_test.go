@@ -0,0 +1,112 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	filename := filepath.Join(dir, "pod.toml")
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoad(t *testing.T) {
+	filename := writeConfig(t, `
+adapter = "hci1"
+advertising_interval_ms = 100
+disconnect_after = "30s"
+
+[version]
+  pm = "4.10.1"
+  lot = 1234
+`)
+	c, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Adapter != "hci1" || c.APIPort != 8080 || c.AdvertisedName != Default().AdvertisedName {
+		t.Errorf("unexpected config: %+v", c)
+	}
+	if c.AdvertisingInterval() != 100*time.Millisecond {
+		t.Errorf("advertising interval %s", c.AdvertisingInterval())
+	}
+	if d, _ := c.DisconnectAfterDuration(); d != 30*time.Second {
+		t.Errorf("disconnect after %s", d)
+	}
+	v, err := c.PodVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.PM != [3]byte{4, 10, 1} || v.PI != [3]byte{1, 3, 0} || v.Lot != 1234 || v.Tid != Default().Version.Tid {
+		t.Errorf("unexpected version: %+v", v)
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	for _, content := range []string{
+		`api_port = 0`,
+		`initial_reservoir = 500`,
+		`advertising_interval_ms = 5`,
+		`disconnect_after = "soon"`,
+		"[version]\npi = \"1.3\"",
+		"[version]\npm = \"4.300.0\"",
+	} {
+		if _, err := Load(writeConfig(t, content)); err == nil {
+			t.Errorf("%q should not load", content)
+		}
+	}
+}
+
+func TestLoad_Pods(t *testing.T) {
+	filename := writeConfig(t, `
+api_port = 8080
+
+[[pod]]
+  adapter = "hci0"
+  state = "phone1.toml"
+
+[[pod]]
+  adapter = "hci1"
+  state = "phone2.toml"
+  api_port = 8081
+  tid = 1234
+`)
+	c, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instances := c.Instances()
+	if len(instances) != 2 {
+		t.Fatalf("got %d pods, want 2", len(instances))
+	}
+	if instances[0].Adapter != "hci0" || instances[0].APIPort != 8080 || instances[0].Version.Tid != Default().Version.Tid {
+		t.Errorf("unexpected first pod: %+v", instances[0])
+	}
+	if instances[1].State != "phone2.toml" || instances[1].APIPort != 8081 || instances[1].Version.Tid != 1234 {
+		t.Errorf("unexpected second pod: %+v", instances[1])
+	}
+
+	filename = writeConfig(t, `
+[[pod]]
+  adapter = "hci0"
+  state = "phone1.toml"
+
+[[pod]]
+  adapter = "hci1"
+  state = "phone2.toml"
+`)
+	if _, err := Load(filename); err == nil {
+		t.Errorf("pods sharing an API port should not load")
+	}
+}
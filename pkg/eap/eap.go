@@ -3,9 +3,11 @@ package eap
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 
 	"github.com/avereha/pod/pkg/message"
+	"github.com/avereha/pod/pkg/random"
 
 	"github.com/davecgh/go-spew/spew"
 	log "github.com/sirupsen/logrus"
@@ -22,14 +24,22 @@ const (
 	CodeSuccess
 	CodeFailure
 
-	SubTypeAkaChallenge = 1
+	SubTypeAkaChallenge              = 1
+	SubTypeAkaAuthenticationReject   = 2
+	SubTypeAkaSynchronizationFailure = 4
 
 	AT_RAND      AttributeType = 1
 	AT_AUTN      AttributeType = 2
 	AT_RES       AttributeType = 3
+	AT_AUTS      AttributeType = 4
 	AT_CUSTOM_IV AttributeType = 126
 )
 
+var (
+	ErrMACMismatch   = errors.New("AUTN MAC-A missmatch")
+	ErrSqnOutOfRange = errors.New("AUTN SQN out of range")
+)
+
 type Attribute struct {
 	Data []byte
 }
@@ -58,6 +68,8 @@ type EapAkaChallenge struct {
 	pdmIV []byte
 	Sqn   uint64
 
+	storedSqn uint64 // last SQN accepted by the pod
+
 	identifier byte
 }
 
@@ -107,6 +119,10 @@ func Unmarshal(data []byte) (*EapAka, error) {
 
 			}
 			data = data[2:10] // 8 bytes
+		case AT_AUTS:
+			if len != 16 {
+				return nil, fmt.Errorf("invalid len received for attribute: %d -- %d", aType, len)
+			}
 		case AT_CUSTOM_IV:
 			if len != 8 {
 				return nil, fmt.Errorf("invalid len received for attribute: %d -- %d", len, aType)
@@ -132,7 +148,7 @@ func (e *EapAka) Marshal() ([]byte, error) {
 	buf.WriteByte(e.Identifier)
 	//len, will fill at the end
 	buf.Write([]byte{0, 0})
-	if len(e.Attributes) == 0 { // short packet: success/failure
+	if len(e.Attributes) == 0 && e.SubType == 0 { // short packet: success/failure
 		len := uint16(buf.Len()) //?
 		e.Len = int(len)
 		log.Tracef("short packet buf len: %d", buf.Len())
@@ -162,6 +178,10 @@ func (e *EapAka) Marshal() ([]byte, error) {
 			buf.WriteByte(0)
 			buf.WriteByte(64) // RES len in bits
 			dataLen = 8
+		case AT_AUTS:
+			len = 4 // 4 * 4 = 16 bytes
+			buf.WriteByte(len)
+			dataLen = 14
 		case AT_CUSTOM_IV:
 			len = 2
 			buf.WriteByte(len)
@@ -180,17 +200,22 @@ func (e *EapAka) Marshal() ([]byte, error) {
 	return ret, nil
 }
 
-func NewEapAkaChallenge(k []byte, sqn uint64) *EapAkaChallenge {
+func NewEapAkaChallenge(k []byte, sqn uint64) (*EapAkaChallenge, error) {
 	op, _ := hex.DecodeString("cdc202d5123e20f62b6d676ac72cb318")
 	// amf, _ := hex.DecodeString("b9b9")
 	log.Debugf("Starting EAP-AKA session with SQN(after incrementing SQN): %d", sqn+1)
-	return &EapAkaChallenge{
-		k:     k,
-		op:    op,
-		Sqn:   sqn + 1,
-		amf:   47545,                      // b9b9
-		podIV: []byte{0xa, 0xa, 0xa, 0xa}, // constant for now, easier to debug. TODO
+	podIV, err := random.Bytes(4, 0x0a) // 0a0a0a0a with seed 0, easier to debug
+	if err != nil {
+		return nil, err
 	}
+	return &EapAkaChallenge{
+		k:         k,
+		op:        op,
+		Sqn:       sqn + 1,
+		storedSqn: sqn,
+		amf:       47545, // b9b9
+		podIV:     podIV,
+	}, nil
 }
 
 func (e *EapAkaChallenge) ParseChallenge(msg *message.Message) error {
@@ -202,6 +227,11 @@ func (e *EapAkaChallenge) ParseChallenge(msg *message.Message) error {
 	}
 
 	log.Debugf("received EAP-AKA challenge: %s", spew.Sdump(eapChallenge))
+	for _, t := range []AttributeType{AT_RAND, AT_AUTN, AT_CUSTOM_IV} {
+		if eapChallenge.Attributes[t] == nil {
+			return fmt.Errorf("attribute %d missing from the EAP-AKA challenge", t)
+		}
+	}
 	e.rand = eapChallenge.Attributes[AT_RAND].Data
 	e.autn = eapChallenge.Attributes[AT_AUTN].Data
 	e.pdmIV = eapChallenge.Attributes[AT_CUSTOM_IV].Data
@@ -210,6 +240,95 @@ func (e *EapAkaChallenge) ParseChallenge(msg *message.Message) error {
 	return nil
 }
 
+// CheckAutn verifies the AUTN of the challenge: AUTN = SQN^AK || AMF || MAC-A.
+// The SQN has to be newer than the last one we accepted. On success, Sqn is
+// set to the SQN of the challenge.
+func (e *EapAkaChallenge) CheckAutn() error {
+	mil := milenage.New(e.k, e.op, e.rand, 0, e.amf)
+	_, _, _, ak, err := mil.F2345()
+	if err != nil {
+		return err
+	}
+	sqnBytes := make([]byte, 6)
+	for i := range sqnBytes {
+		sqnBytes[i] = e.autn[i] ^ ak[i]
+	}
+	var sqn uint64
+	for _, b := range sqnBytes {
+		sqn = sqn<<8 | uint64(b)
+	}
+	amf := e.autn[6:8]
+
+	mil.SQN = sqnBytes
+	mil.AMF = amf
+	xmac, err := mil.F1()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(xmac, e.autn[8:16]) {
+		return fmt.Errorf("%w: got %x, want %x", ErrMACMismatch, e.autn[8:16], xmac)
+	}
+	if sqn <= e.storedSqn {
+		return fmt.Errorf("%w: got %d, last accepted %d", ErrSqnOutOfRange, sqn, e.storedSqn)
+	}
+	log.Debugf("EapAka AUTN ok, SQN: %d", sqn)
+	e.Sqn = sqn
+	e.amf = uint16(amf[0])<<8 | uint16(amf[1])
+	return nil
+}
+
+// GenerateAuthenticationReject is the answer to a challenge with a bad MAC-A
+func (e *EapAkaChallenge) GenerateAuthenticationReject() (*message.Message, error) {
+	eap := &EapAka{
+		Code:       CodeResponse,
+		Attributes: make(map[AttributeType]*Attribute),
+		SubType:    SubTypeAkaAuthenticationReject,
+		Identifier: e.identifier,
+	}
+	return e.eapMessage(eap)
+}
+
+// GenerateSynchronizationFailure is the answer to a challenge with an old SQN.
+// AT_AUTS = SQN_MS^AK* || MAC-S tells the app which SQN we have.
+func (e *EapAkaChallenge) GenerateSynchronizationFailure() (*message.Message, error) {
+	mil := milenage.New(e.k, e.op, e.rand, e.storedSqn, 0)
+	aks, err := mil.F5Star()
+	if err != nil {
+		return nil, err
+	}
+	macs, err := mil.F1Star(mil.SQN, []byte{0, 0})
+	if err != nil {
+		return nil, err
+	}
+	auts := make([]byte, 0, 14)
+	for i := range aks {
+		auts = append(auts, mil.SQN[i]^aks[i])
+	}
+	auts = append(auts, macs...)
+
+	eap := &EapAka{
+		Code:       CodeResponse,
+		Attributes: make(map[AttributeType]*Attribute),
+		SubType:    SubTypeAkaSynchronizationFailure,
+		Identifier: e.identifier,
+	}
+	eap.Attributes[AT_AUTS] = &Attribute{
+		Data: auts,
+	}
+	log.Debugf("EapAka AUTS %x, SQN: %d", auts, e.storedSqn)
+	return e.eapMessage(eap)
+}
+
+func (e *EapAkaChallenge) eapMessage(eap *EapAka) (*message.Message, error) {
+	var err error
+	ret := message.NewMessage(message.MessageTypeSessionEstablishment, e.podID, e.pdmID)
+	ret.Payload, err = eap.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
 func (e *EapAkaChallenge) SqnBytes() []byte {
 	return nil
 }
@@ -231,8 +350,6 @@ func (e *EapAkaChallenge) GenerateChallengeResponse() (*message.Message, error)
 		e.amf,
 	)
 
-	// TODO check AUTN
-
 	// TODO check if IK/AK is used for anything
 	e.res, e.ck, _, _, err = mil.F2345()
 	if err != nil {
@@ -1,6 +1,9 @@
 package eap
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -74,3 +77,67 @@ func TestEapAka_MarshalUnmarshal(t *testing.T) {
 		})
 	}
 }
+
+func fromHex(t *testing.T, s string) []byte {
+	ret, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+// values from scripts/testdata/from_logs.ini, where seq is the SQN stored
+// before the session
+func TestEapAkaChallenge_CheckAutn(t *testing.T) {
+	ltk := fromHex(t, "c0772899720972a314f557de66d571dd")
+	newChallenge := func(storedSqn uint64, autn []byte) *EapAkaChallenge {
+		e, err := NewEapAkaChallenge(ltk, storedSqn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.rand = fromHex(t, "c2cd1248451103bd77a6c7ef88c441ba")
+		e.autn = autn
+		return e
+	}
+	autn := fromHex(t, "00c55c78e8d3b9b9e935860a7259f6c0")
+
+	e := newChallenge(1, autn)
+	if err := e.CheckAutn(); err != nil {
+		t.Fatal(err)
+	}
+	if e.Sqn != 2 {
+		t.Errorf("Sqn = %d, want 2", e.Sqn)
+	}
+	if _, err := e.GenerateChallengeResponse(); err != nil {
+		t.Fatal(err)
+	}
+	if want := fromHex(t, "a40bc6d13861447e"); !bytes.Equal(e.res, want) {
+		t.Errorf("RES = %x, want %x", e.res, want)
+	}
+	if want := fromHex(t, "55799fd26664cbf6e476525e2dee52c6"); !bytes.Equal(e.ck, want) {
+		t.Errorf("CK = %x, want %x", e.ck, want)
+	}
+
+	e = newChallenge(2, autn)
+	if err := e.CheckAutn(); !errors.Is(err, ErrSqnOutOfRange) {
+		t.Errorf("replayed SQN: expected ErrSqnOutOfRange, got %v", err)
+	}
+	auts, err := e.GenerateSynchronizationFailure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := Unmarshal(auts.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.SubType != SubTypeAkaSynchronizationFailure || len(back.Attributes[AT_AUTS].Data) != 14 {
+		t.Errorf("unexpected synchronization failure: %x", auts.Payload)
+	}
+
+	bad := append([]byte{}, autn...)
+	bad[15] ^= 1
+	e = newChallenge(1, bad)
+	if err := e.CheckAutn(); !errors.Is(err, ErrMACMismatch) {
+		t.Errorf("bad MAC: expected ErrMACMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrAckMismatch = errors.New("unexpected ACK number")
+
+// Exchange follows the sequence and ACK numbers of the messages in one
+// session, as seen by the pod. Sequence numbers are 8 bits and wrap around
+// from 255 to 0.
+type Exchange struct {
+	lastSeq uint8
+	started bool
+
+	// the last response we sent, until the central ACKs it
+	response   *Message
+	waitingAck bool
+}
+
+// IsDuplicate reports whether msg is a retry of the last message received.
+// This happens when our response got lost.
+func (e *Exchange) IsDuplicate(msg *Message) bool {
+	return e.started && msg.SequenceNumber == e.lastSeq
+}
+
+// IsInSequence reports whether msg has the sequence number that follows
+// the last message received.
+func (e *Exchange) IsInSequence(msg *Message) bool {
+	return !e.started || msg.SequenceNumber == e.lastSeq+1
+}
+
+// Received records msg as the last message from the central and checks the
+// ACK number when we are waiting for one. A new command without an ACK is
+// accepted in place of the ACK.
+func (e *Exchange) Received(msg *Message) error {
+	e.lastSeq = msg.SequenceNumber
+	e.started = true
+	if !e.waitingAck {
+		return nil
+	}
+	want := e.response.SequenceNumber + 1
+	e.waitingAck = false
+	e.response = nil
+	if msg.Ack && msg.AckNumber != want {
+		return fmt.Errorf("%w: got %d, want %d", ErrAckMismatch, msg.AckNumber, want)
+	}
+	return nil
+}
+
+// Sent records the response to the last message received. It is sent
+// again if the central repeats that message.
+func (e *Exchange) Sent(response *Message) {
+	e.response = response
+	e.waitingAck = true
+}
+
+// LastResponse returns the response that was not ACKed yet, if any
+func (e *Exchange) LastResponse() *Message {
+	return e.response
+}
+
+func (e *Exchange) WaitingForAck() bool {
+	return e.waitingAck
+}
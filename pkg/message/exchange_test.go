@@ -0,0 +1,54 @@
+package message
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExchange(t *testing.T) {
+	var e Exchange
+
+	cmd := &Message{SequenceNumber: 255}
+	if e.IsDuplicate(cmd) || !e.IsInSequence(cmd) {
+		t.Fatalf("first message of a session should be new")
+	}
+	if err := e.Received(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if !e.IsDuplicate(cmd) {
+		t.Fatalf("same sequence number should be a duplicate")
+	}
+
+	rsp := &Message{SequenceNumber: 255, Ack: true, AckNumber: 0}
+	e.Sent(rsp)
+	if e.LastResponse() != rsp || !e.WaitingForAck() {
+		t.Fatalf("response should be cached until ACKed")
+	}
+
+	// sequence numbers wrap around
+	ack := &Message{SequenceNumber: 0, Ack: true, AckNumber: 0}
+	if e.IsDuplicate(ack) || !e.IsInSequence(ack) {
+		t.Fatalf("sequence number 0 should follow 255")
+	}
+	if err := e.Received(ack); err != nil {
+		t.Fatal(err)
+	}
+	if e.LastResponse() != nil || e.WaitingForAck() {
+		t.Fatalf("response should be dropped once ACKed")
+	}
+
+	e.Sent(&Message{SequenceNumber: 1})
+	bad := &Message{SequenceNumber: 1, Ack: true, AckNumber: 5}
+	if err := e.Received(bad); !errors.Is(err, ErrAckMismatch) {
+		t.Fatalf("expected ErrAckMismatch, got: %v", err)
+	}
+
+	// a new command without ACK replaces the ACK
+	e.Sent(&Message{SequenceNumber: 2})
+	if err := e.Received(&Message{SequenceNumber: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if e.WaitingForAck() {
+		t.Fatalf("new command should replace the ACK")
+	}
+}
@@ -0,0 +1,185 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Minimal Prometheus text exposition, so we don't need the client library on the pi.
+
+type collector interface {
+	write(w io.Writer)
+}
+
+type Registry struct {
+	mtx        sync.Mutex
+	collectors []collector
+}
+
+var Default = &Registry{}
+
+func (r *Registry) register(c collector) {
+	r.mtx.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mtx.Unlock()
+}
+
+func (r *Registry) Write(w io.Writer) {
+	r.mtx.Lock()
+	collectors := make([]collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.mtx.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.Write(w)
+	})
+}
+
+// CounterVec is a counter partitioned by label values
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mtx    sync.Mutex
+	values map[string]uint64
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	ret := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]uint64),
+	}
+	Default.register(ret)
+	return ret
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(n uint64, labelValues ...string) {
+	if len(labelValues) != len(c.labels) {
+		panic(fmt.Sprintf("pkg metrics; %s expects %d label values, got %d", c.name, len(c.labels), len(labelValues)))
+	}
+	key := formatLabels(c.labels, labelValues)
+	c.mtx.Lock()
+	c.values[key] += n
+	c.mtx.Unlock()
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+		return
+	}
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, k, c.values[k])
+	}
+}
+
+// GaugeFunc is a gauge whose value is read when the metrics are scraped
+type GaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func NewGaugeFunc(name, help string, value func() float64) *GaugeFunc {
+	ret := &GaugeFunc{
+		name:  name,
+		help:  help,
+		value: value,
+	}
+	Default.register(ret)
+	return ret
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %g\n", g.name, g.value())
+}
+
+// GaugeFuncVec is a gauge with one value function per label value, for
+// values that exist once per pod
+type GaugeFuncVec struct {
+	name  string
+	help  string
+	label string
+
+	mtx    sync.Mutex
+	values map[string]func() float64
+}
+
+func NewGaugeFuncVec(name, help, label string) *GaugeFuncVec {
+	ret := &GaugeFuncVec{
+		name:   name,
+		help:   help,
+		label:  label,
+		values: make(map[string]func() float64),
+	}
+	Default.register(ret)
+	return ret
+}
+
+// Set reads the gauge for labelValue from value, replacing any previous function
+func (g *GaugeFuncVec) Set(labelValue string, value func() float64) {
+	g.mtx.Lock()
+	g.values[labelValue] = value
+	g.mtx.Unlock()
+}
+
+func (g *GaugeFuncVec) write(w io.Writer) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	writeHeader(w, g.name, g.help, "gauge")
+	keys := make([]string, 0, len(g.values))
+	for k := range g.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %g\n", g.name, formatLabels([]string{g.label}, []string{k}), g.values[k]())
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", names[i], labelEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
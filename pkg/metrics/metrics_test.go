@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRegistry_Write(t *testing.T) {
+	r := &Registry{}
+	commands := &CounterVec{
+		name:   "test_commands_total",
+		help:   "Commands received.",
+		labels: []string{"type"},
+		values: make(map[string]uint64),
+	}
+	timeouts := &CounterVec{
+		name:   "test_timeouts_total",
+		help:   "Timeouts.",
+		values: make(map[string]uint64),
+	}
+	reservoir := &GaugeFunc{
+		name:  "test_reservoir_units",
+		help:  "Insulin left.",
+		value: func() float64 { return 42.5 },
+	}
+	progress := &GaugeFuncVec{
+		name:   "test_progress",
+		help:   "Pod progress.",
+		label:  "pod",
+		values: make(map[string]func() float64),
+	}
+	r.register(commands)
+	r.register(timeouts)
+	r.register(reservoir)
+	r.register(progress)
+
+	progress.Set("hci1", func() float64 { return 9 })
+	progress.Set("hci0", func() float64 { return 8 })
+
+	commands.Inc("GET_STATUS")
+	commands.Inc("GET_STATUS")
+	commands.Inc(`we"ird`)
+
+	var buf bytes.Buffer
+	r.Write(&buf)
+
+	want := `# HELP test_commands_total Commands received.
+# TYPE test_commands_total counter
+test_commands_total{type="GET_STATUS"} 2
+test_commands_total{type="we\"ird"} 1
+# HELP test_timeouts_total Timeouts.
+# TYPE test_timeouts_total counter
+test_timeouts_total 0
+# HELP test_reservoir_units Insulin left.
+# TYPE test_reservoir_units gauge
+test_reservoir_units 42.5
+# HELP test_progress Pod progress.
+# TYPE test_progress gauge
+test_progress{pod="hci0"} 8
+test_progress{pod="hci1"} 9
+`
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Errorf("Registry.Write() mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"golang.org/x/crypto/curve25519"
 
 	"github.com/avereha/pod/pkg/message"
+	"github.com/avereha/pod/pkg/random"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/jacobsa/crypto/cmac"
@@ -24,6 +25,30 @@ const (
 	p0     = "P0="
 )
 
+// step is the next message we expect from the PDM
+type step int
+
+const (
+	stepSP1SP2 step = iota
+	stepSPS1
+	stepSPS2
+	stepSP0GP0
+	stepDone
+)
+
+var stepNames = map[step]string{
+	stepSP1SP2: sp1 + sp2,
+	stepSPS1:   sps1,
+	stepSPS2:   sps2,
+	stepSP0GP0: sp0gp0,
+	stepDone:   "nothing",
+}
+
+var (
+	ErrOutOfOrder   = errors.New("pairing step out of order")
+	ErrConfMismatch = errors.New("invalid conf value")
+)
+
 type Pair struct {
 	podPublic  []byte
 	podPrivate []byte
@@ -40,17 +65,51 @@ type Pair struct {
 
 	ltk     []byte
 	confKey []byte // key used to sign the "Conf" values
+
+	step step
+}
+
+// expect makes sure msg is the pairing step we are waiting for
+func (c *Pair) expect(msg *message.Message) error {
+	if msg.Type != message.MessageTypePairing {
+		return fmt.Errorf("%w: expected %s, got message type %d", ErrOutOfOrder, stepNames[c.step], msg.Type)
+	}
+	got, ok := receivedStep(msg.Payload)
+	if !ok {
+		return fmt.Errorf("unknown pairing message, expected %s: %x", stepNames[c.step], msg.Payload)
+	}
+	if got != c.step {
+		return fmt.Errorf("%w: expected %s, got %s", ErrOutOfOrder, stepNames[c.step], stepNames[got])
+	}
+	return nil
+}
+
+func receivedStep(payload []byte) (step, bool) {
+	switch {
+	case bytes.HasPrefix(payload, []byte(sp1)):
+		return stepSP1SP2, true
+	case bytes.HasPrefix(payload, []byte(sps1)):
+		return stepSPS1, true
+	case bytes.HasPrefix(payload, []byte(sps2)):
+		return stepSPS2, true
+	case bytes.HasPrefix(payload, []byte(sp0gp0)):
+		return stepSP0GP0, true
+	}
+	return 0, false
 }
 
 func parseStringByte(expectedNames []string, data []byte) (map[string][]byte, error) {
 	ret := make(map[string][]byte)
 	for _, name := range expectedNames {
 		n := len(name)
-		if string(data[:n]) != name {
+		if len(data) < n+2 || string(data[:n]) != name {
 			return nil, fmt.Errorf("Name not found %s in %x", name, data)
 		}
 		data = data[n:]
 		length := int(data[0])<<8 | int(data[1])
+		if len(data) < 2+length {
+			return nil, fmt.Errorf("Field %s is too short: %d bytes, want %d", name, len(data)-2, length)
+		}
 		ret[name] = data[2 : 2+length]
 		log.Tracef("Read field: %s :: %x :: %d", name, ret[name], len(ret[name]))
 
@@ -73,6 +132,9 @@ func buildStringByte(names []string, values map[string][]byte) ([]byte, error) {
 
 func (c *Pair) ParseSP1SP2(msg *message.Message) error {
 	log.Infof("Received SP1 SP2 payload %x", msg.Payload)
+	if err := c.expect(msg); err != nil {
+		return err
+	}
 
 	sp, err := parseStringByte([]string{sp1, sp2}, msg.Payload)
 	if err != nil {
@@ -83,16 +145,23 @@ func (c *Pair) ParseSP1SP2(msg *message.Message) error {
 	log.Infof("Received SP1 SP2: %x :: %x", sp[sp1], sp[sp2])
 	c.podID = msg.Destination
 	c.pdmID = msg.Source
+	c.step = stepSPS1
 	return nil
 }
 
 func (c *Pair) ParseSPS1(msg *message.Message) error {
+	if err := c.expect(msg); err != nil {
+		return err
+	}
 	sp, err := parseStringByte([]string{sps1}, msg.Payload)
 	if err != nil {
 		log.Debugf("Message :%s", spew.Sdump(msg))
 		return err
 	}
 	log.Infof("Received SPS1  %x", sp[sps1])
+	if len(sp[sps1]) != 48 {
+		return fmt.Errorf("SPS1 should have 48 bytes, got %d: %x", len(sp[sps1]), sp[sps1])
+	}
 	pdmPublic := sp[sps1][:32]
 	pdmNonce := sp[sps1][32:]
 
@@ -108,6 +177,7 @@ func (c *Pair) ParseSPS1(msg *message.Message) error {
 	if err != nil {
 		return err
 	}
+	c.step = stepSPS2
 	return nil
 }
 
@@ -137,16 +207,20 @@ func (c *Pair) GenerateSPS1() (*message.Message, error) {
 }
 
 func (c *Pair) ParseSPS2(msg *message.Message) error {
+	if err := c.expect(msg); err != nil {
+		return err
+	}
 	sp, err := parseStringByte([]string{sps2}, msg.Payload)
 	if err != nil {
 		log.Debugf("Message :%s", spew.Sdump(msg))
 		return err
 	}
 
-	if !bytes.Equal(c.pdmConf, sp[sps2]) {
-		return fmt.Errorf("Invalid conf value. Expected: %x. Got %x", c.pdmConf, sp[sps2])
+	if c.pdmConf == nil || !bytes.Equal(c.pdmConf, sp[sps2]) {
+		return fmt.Errorf("%w. Expected: %x. Got %x", ErrConfMismatch, c.pdmConf, sp[sps2])
 	}
 	log.Debugf("Validated PDM SPS2: %x", sp[sps2])
+	c.step = stepSP0GP0
 	return nil
 }
 
@@ -165,11 +239,15 @@ func (c *Pair) GenerateSPS2() (*message.Message, error) {
 }
 
 func (c *Pair) ParseSP0GP0(msg *message.Message) error {
+	if err := c.expect(msg); err != nil {
+		return err
+	}
 	if string(msg.Payload) != sp0gp0 {
 		log.Debugf("Message :%s", spew.Sdump(msg))
 		return fmt.Errorf("Expected SP0GP0, got %x", msg.Payload)
 	}
 	log.Debugf("Parsed SP0GP0")
+	c.step = stepDone
 	return nil
 }
 
@@ -185,6 +263,9 @@ func (c *Pair) GenerateP0() (*message.Message, error) {
 }
 
 func (c *Pair) LTK() ([]byte, error) {
+	if c.step != stepDone {
+		return nil, fmt.Errorf("pairing is not completed, waiting for %s", stepNames[c.step])
+	}
 	if c.curve25519LTK != nil {
 		return c.ltk, nil
 	}
@@ -193,14 +274,14 @@ func (c *Pair) LTK() ([]byte, error) {
 
 func (c *Pair) computeMyData() error {
 	var err error
-	c.podPrivate = make([]byte, 32)
-	c.podPublic = make([]byte, 32)
-	c.podNonce = make([]byte, 16) // 0 for now TODO
-	/*
-		if _, err := rand.Read(podPrivateKey); err != nil {
-			return nil, nil, nil, err
-		}
-	*/
+	c.podPrivate, err = random.Bytes(32, 0)
+	if err != nil {
+		return err
+	}
+	c.podNonce, err = random.Bytes(16, 0)
+	if err != nil {
+		return err
+	}
 	c.podPrivate[0] &= 248
 	c.podPrivate[31] &= 127
 	c.podPrivate[31] |= 64
@@ -0,0 +1,115 @@
+package pair
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/avereha/pod/pkg/message"
+	"github.com/avereha/pod/pkg/random"
+)
+
+func pairingMessage(payload []byte) *message.Message {
+	return &message.Message{
+		Type:    message.MessageTypePairing,
+		Payload: payload,
+	}
+}
+
+var sp1sp2Payload = []byte("SP1=\x00\x04\xff\xff\xff\xfe,SP2=\x00\x04\x00\x00\x00\x05")
+
+func fromHex(t *testing.T, s string) []byte {
+	ret, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+// values from scripts/testdata/from_logs.ini, that need the fixed pod key and nonce
+func TestPair_KnownAnswer(t *testing.T) {
+	random.UseSeed(0)
+	defer random.UseCryptoRand()
+
+	var sps1Payload bytes.Buffer
+	sps1Payload.WriteString(sps1)
+	sps1Payload.Write([]byte{0, 48})
+	sps1Payload.Write(fromHex(t, "532f777e6e1cad4ed2154637e9f213f35f8a9c7ddb8fcb13a7d64b462d728a47"))
+	sps1Payload.Write(fromHex(t, "d04b54d0fcd312cf6e0999f6a29a6c7b"))
+
+	p := &Pair{}
+	if err := p.ParseSP1SP2(pairingMessage(sp1sp2Payload)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ParseSPS1(pairingMessage(sps1Payload.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.GenerateSPS1(); err != nil {
+		t.Fatal(err)
+	}
+	if want := fromHex(t, "2fe57da347cd62431528daac5fbb290730fff684afc4cfc2ed90995f58cb3b74"); !bytes.Equal(p.podPublic, want) {
+		t.Errorf("pod public = %x, want %x", p.podPublic, want)
+	}
+	if want := fromHex(t, "b03664472d86d24537af5ec866e2716e"); !bytes.Equal(p.pdmConf, want) {
+		t.Errorf("pdm conf = %x, want %x", p.pdmConf, want)
+	}
+	if err := p.ParseSPS2(pairingMessage(append([]byte(sps2+"\x00\x10"), p.pdmConf...))); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ParseSP0GP0(pairingMessage([]byte(sp0gp0))); err != nil {
+		t.Fatal(err)
+	}
+	ltk, err := p.LTK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fromHex(t, "bdbeb456476a11bce90eead520dff2e1"); !bytes.Equal(ltk, want) {
+		t.Errorf("LTK = %x, want %x", ltk, want)
+	}
+}
+
+func TestPair_RandomKeys(t *testing.T) {
+	a, b := &Pair{}, &Pair{}
+	if err := a.computeMyData(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.computeMyData(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(a.podPublic, b.podPublic) || bytes.Equal(a.podNonce, b.podNonce) {
+		t.Errorf("two pods got the same keys")
+	}
+}
+
+func TestPair_Errors(t *testing.T) {
+	p := &Pair{}
+	if err := p.ParseSPS1(pairingMessage([]byte(sps1 + "\x00\x00"))); !errors.Is(err, ErrOutOfOrder) {
+		t.Errorf("SPS1 before SP1SP2: expected ErrOutOfOrder, got %v", err)
+	}
+	if err := p.ParseSP1SP2(pairingMessage(sp1sp2Payload)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ParseSPS1(pairingMessage([]byte(sp0gp0))); !errors.Is(err, ErrOutOfOrder) {
+		t.Errorf("SP0GP0 instead of SPS1: expected ErrOutOfOrder, got %v", err)
+	}
+
+	var sps1Payload bytes.Buffer
+	sps1Payload.WriteString(sps1)
+	sps1Payload.Write([]byte{0, 48})
+	sps1Payload.Write(make([]byte, 48))
+	sps1Payload.Bytes()[len(sps1)+2] = 9 // a valid curve25519 point
+	if err := p.ParseSPS1(pairingMessage(sps1Payload.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.GenerateSPS1(); err != nil {
+		t.Fatal(err)
+	}
+	badConf := append([]byte(sps2+"\x00\x10"), make([]byte, 16)...)
+	if err := p.ParseSPS2(pairingMessage(badConf)); !errors.Is(err, ErrConfMismatch) {
+		t.Errorf("bad SPS2: expected ErrConfMismatch, got %v", err)
+	}
+	if _, err := p.LTK(); err == nil {
+		t.Errorf("LTK should not be available after a failed pairing")
+	}
+}
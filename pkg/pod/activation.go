@@ -0,0 +1,103 @@
+package pod
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/avereha/pod/pkg/command"
+	"github.com/avereha/pod/pkg/response"
+)
+
+const (
+	// Prime and cannula insertion pulses are given faster than a bolus
+	activationPulseInterval = time.Second
+	// A pod that is not running this long after pairing gives up
+	activationWindow = time.Hour
+)
+
+// activationBolus reports whether a bolus is the prime or the cannula
+// insertion, from the activation phase the pod is in. The apps send 0x08
+// after pairing to get the pod ready to prime: the first bolus after it
+// primes the pod, the first one after priming inserts the cannula.
+func (p *PODState) activationBolus(c *command.ProgramInsulin) (response.PodProgress, bool) {
+	if c.TableNum != 2 {
+		return 0, false
+	}
+	switch {
+	case p.PodProgress >= response.PodProgressPairingCompleted && p.PodProgress < response.PodProgressPrimingCompleted:
+		if p.DeliveryFlags == nil {
+			log.Warnf("pkg pod; bolus before the delivery flags were configured with 0x08, not priming")
+			return 0, false
+		}
+		return response.PodProgressPriming, true
+	case p.PodProgress >= response.PodProgressPrimingCompleted && p.PodProgress < response.PodProgressRunningAbove50U:
+		return response.PodProgressInsertingCannula, true
+	}
+	return 0, false
+}
+
+// updateActivation moves the pod to the next activation phase once priming
+// or cannula insertion is done, and gives up on activation when the pod was
+// not running in time
+func (p *PODState) updateActivation(now time.Time) {
+	switch p.PodProgress {
+	case response.PodProgressPriming:
+		if !p.BolusEnd.After(now) {
+			log.Infof("pkg pod; priming completed")
+			p.PodProgress = response.PodProgressPrimingCompleted
+		}
+	case response.PodProgressInsertingCannula:
+		if !p.BolusEnd.After(now) {
+			log.Infof("pkg pod; cannula inserted, the pod is running")
+			p.PodProgress = p.runningProgress()
+			return
+		}
+	}
+	if p.PodProgress >= response.PodProgressPairingCompleted && p.PodProgress < response.PodProgressInsertingCannula &&
+		!p.PairedAt.IsZero() && now.Sub(p.PairedAt) > activationWindow {
+		log.Warnf("pkg pod; not activated within %s of pairing", activationWindow)
+		p.PodProgress = response.PodProgressActivationTimeExceeded
+		p.BasalActive = false
+		p.BolusEnd = time.Time{}
+	}
+}
+
+// runningProgress is the PodProgress of a running pod, by reservoir level
+func (p *PODState) runningProgress() response.PodProgress {
+	if p.Reservoir < 50/0.05 {
+		return response.PodProgressRunningBelow50U
+	}
+	return response.PodProgressRunningAbove50U
+}
+
+// paired records the SetUniqueID, which starts the activation window
+func (p *PODState) paired(now time.Time) {
+	if p.PodProgress < response.PodProgressPairingCompleted {
+		p.PodProgress = response.PodProgressPairingCompleted
+		p.PairedAt = now
+		p.DeliveryFlags = nil // configured again for this activation
+	}
+}
+
+// startActivationBolus starts priming or cannula insertion when c is one of
+// those boluses. It returns false for the other 0x1a commands.
+func (p *PODState) startActivationBolus(c *command.ProgramInsulin, now time.Time) bool {
+	phase, ok := p.activationBolus(c)
+	if !ok {
+		return false
+	}
+	if p.PodProgress == phase {
+		log.Infof("pkg pod; already in activation phase %d, ignoring the bolus", phase)
+		return true
+	}
+	if phase == response.PodProgressInsertingCannula && p.PodProgress != response.PodProgressBasalInitialized {
+		log.Warnf("pkg pod; inserting the cannula before the basal schedule was programmed")
+	}
+	log.Infof("pkg pod; activation phase %d, %d pulses", phase, c.Pulses)
+	p.PodProgress = phase
+	p.BolusNotDelivered = 0
+	pulses := p.takeFromReservoir(c.Pulses)
+	p.BolusEnd = now.Add(time.Duration(pulses) * activationPulseInterval)
+	return true
+}
@@ -0,0 +1,66 @@
+package pod
+
+import (
+	"time"
+
+	"github.com/avereha/pod/pkg/bluetooth"
+	"github.com/avereha/pod/pkg/response"
+	log "github.com/sirupsen/logrus"
+)
+
+// advertisement is what a real DASH pod advertises at this point of its life
+func (p *PODState) advertisement() bluetooth.Advertisement {
+	ret := bluetooth.Advertisement{
+		State: bluetooth.AdvertisePaired,
+		PodId: p.Id,
+	}
+	switch {
+	case p.Id == nil || p.PodProgress < response.PodProgressPairingCompleted:
+		ret.State = bluetooth.AdvertiseUnpaired
+	case p.PodProgress == response.PodProgressPodInactive:
+		ret.State = bluetooth.AdvertiseInactive
+	}
+	return ret
+}
+
+// updateAdvertising makes the advertisements follow the pod progress
+func (p *Pod) updateAdvertising() {
+	if p.ble == nil {
+		return
+	}
+	p.mtx.Lock()
+	a := p.state.advertisement()
+	p.mtx.Unlock()
+	if err := p.ble.Advertise(a); err != nil {
+		log.Warnf("pkg pod; could not update the advertising: %s", err)
+	}
+}
+
+// PauseAdvertising makes the pod invisible to scanning centrals, as if it
+// was out of range
+func (p *Pod) PauseAdvertising() error {
+	if err := p.ble.PauseAdvertising(); err != nil {
+		return err
+	}
+	p.emitEvent(EventAdvertising, "advertising paused")
+	p.notifyStateChange()
+	return nil
+}
+
+func (p *Pod) ResumeAdvertising() error {
+	if err := p.ble.ResumeAdvertising(); err != nil {
+		return err
+	}
+	p.emitEvent(EventAdvertising, "advertising resumed")
+	p.notifyStateChange()
+	return nil
+}
+
+func (p *Pod) SetAdvertisingInterval(interval time.Duration) error {
+	if err := p.ble.SetAdvertisingInterval(interval); err != nil {
+		return err
+	}
+	p.emitEvent(EventAdvertising, "advertising every %s", interval)
+	p.notifyStateChange()
+	return nil
+}
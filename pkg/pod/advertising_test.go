@@ -0,0 +1,30 @@
+package pod
+
+import (
+	"testing"
+
+	"github.com/avereha/pod/pkg/bluetooth"
+	"github.com/avereha/pod/pkg/response"
+)
+
+func TestPODState_Advertisement(t *testing.T) {
+	id := []byte{0, 0, 0x12, 0x34}
+	for _, tt := range []struct {
+		id       []byte
+		progress response.PodProgress
+		want     bluetooth.AdvertisingState
+	}{
+		{nil, response.PodProgressInitial, bluetooth.AdvertiseUnpaired},
+		{nil, response.PodProgressReminderInitialized, bluetooth.AdvertiseUnpaired},
+		{id, response.PodProgressPairingCompleted, bluetooth.AdvertisePaired},
+		{id, response.PodProgressRunningAbove50U, bluetooth.AdvertisePaired},
+		{id, response.PodProgressFault, bluetooth.AdvertisePaired},
+		{id, response.PodProgressPodInactive, bluetooth.AdvertiseInactive},
+	} {
+		state := &PODState{Id: tt.id, PodProgress: tt.progress}
+		a := state.advertisement()
+		if a.State != tt.want {
+			t.Errorf("progress %d: got %s, want %s", tt.progress, a.State, tt.want)
+		}
+	}
+}
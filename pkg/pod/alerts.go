@@ -0,0 +1,146 @@
+package pod
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/avereha/pod/pkg/command"
+	"github.com/avereha/pod/pkg/response"
+)
+
+// PendingAlert is an alert programmed with 0x19 that did not fire yet. It
+// fires at At, or when the reservoir gets below Reservoir pulses.
+type PendingAlert struct {
+	Slot      uint8            `toml:"slot"`
+	At        time.Time        `toml:"at"`
+	Reservoir uint16           `toml:"reservoir"`
+	BeepType  command.BeepType `toml:"beep_type"`
+}
+
+func (a *PendingAlert) due(state *PODState, now time.Time) bool {
+	if a.At.IsZero() {
+		return state.Reservoir <= a.Reservoir
+	}
+	return !a.At.After(now)
+}
+
+func alertSlotName(slot uint8) string {
+	switch 1 << slot {
+	case response.AlertSlotAutoOff:
+		return "auto-off"
+	case response.AlertSlotShutdownImminent:
+		return "shutdown imminent"
+	case response.AlertSlotExpirationAdvisor:
+		return "expiration reminder"
+	case response.AlertSlotLowReservoir:
+		return "low reservoir"
+	case response.AlertSlotSuspendInProgress:
+		return "suspend in progress"
+	case response.AlertSlotSuspendEnded:
+		return "suspend ended"
+	case response.AlertSlotExpired:
+		return "expired"
+	}
+	return fmt.Sprintf("slot %d", slot)
+}
+
+// programAlerts applies a 0x19 command: active alerts replace the pending
+// alert of their slot, inactive ones cancel it. p.mtx must be held.
+func (p *Pod) programAlerts(c *command.ProgramAlerts, now time.Time) {
+	for _, a := range c.Alerts {
+		pending := p.state.PendingAlerts[:0]
+		for _, old := range p.state.PendingAlerts {
+			if old.Slot != a.Slot {
+				pending = append(pending, old)
+			}
+		}
+		p.state.PendingAlerts = pending
+		if !a.Active {
+			log.Infof("pkg pod; alert %s cancelled", alertSlotName(a.Slot))
+			continue
+		}
+
+		alert := PendingAlert{Slot: a.Slot, BeepType: a.BeepType}
+		if a.ReservoirTrigger {
+			// the trigger is in units of 0.1U
+			alert.Reservoir = a.Trigger * 2
+			log.Infof("pkg pod; alert %s at %.2fU in the reservoir", alertSlotName(a.Slot), float32(alert.Reservoir)*0.05)
+		} else {
+			alert.At = now.Add(time.Duration(a.Trigger) * time.Minute)
+			log.Infof("pkg pod; alert %s in %d minutes", alertSlotName(a.Slot), a.Trigger)
+			time.AfterFunc(alert.At.Sub(now), p.checkAlerts)
+		}
+		p.state.PendingAlerts = append(p.state.PendingAlerts, alert)
+	}
+	p.fireAlerts(now)
+}
+
+// fireAlerts activates the alert slots of the pending alerts that are due.
+// It returns whether any fired. p.mtx must be held.
+func (p *Pod) fireAlerts(now time.Time) bool {
+	fired := false
+	pending := p.state.PendingAlerts[:0]
+	for _, a := range p.state.PendingAlerts {
+		if !a.due(p.state, now) {
+			pending = append(pending, a)
+			continue
+		}
+		fired = true
+		p.state.ActiveAlertSlots |= 1 << a.Slot
+		p.emitEvent(EventAlert, "alert %s", alertSlotName(a.Slot))
+		if a.BeepType != command.BeepNone {
+			p.beep(a.BeepType, alertSlotName(a.Slot)+" alert")
+		}
+	}
+	p.state.PendingAlerts = pending
+	return fired
+}
+
+// checkAlerts fires the alerts that are due while no command comes in
+func (p *Pod) checkAlerts() {
+	p.mtx.Lock()
+	fired := p.fireAlerts(time.Now())
+	if fired {
+		if err := p.state.Save(); err != nil {
+			log.Errorf("pkg pod; could not save the pod state: %s", err)
+		}
+	}
+	p.mtx.Unlock()
+	if fired {
+		p.notifyStateChange()
+	}
+}
+
+// scheduleAlerts arms the timers of the pending alerts, after a restart
+func (p *Pod) scheduleAlerts() {
+	now := time.Now()
+	for _, a := range p.state.PendingAlerts {
+		if !a.At.IsZero() {
+			time.AfterFunc(a.At.Sub(now), p.checkAlerts)
+		}
+	}
+}
+
+// stopDelivery applies a 0x1f command. Stopping all deliveries suspends
+// the pod until a basal schedule is programmed again. p.mtx must be held.
+func (p *Pod) stopDelivery(c *command.StopDelivery, now time.Time) {
+	if c.StopBolus {
+		p.state.BolusNotDelivered = p.state.cancelBolus(now)
+		p.state.ExtendedBolusActive = false
+	}
+	if c.StopTempBasal {
+		p.state.TempBasalEnd = time.Time{}
+	}
+	if c.StopBasal {
+		p.state.BasalActive = false
+	}
+	if c.StopsAll() && p.state.SuspendedAt.IsZero() {
+		log.Infof("pkg pod; delivery suspended")
+		p.state.SuspendedAt = now
+	}
+	if c.BeepType != command.BeepNone && c.BeepType != command.BeepNoneKeepCurrent {
+		p.beep(c.BeepType, "delivery stopped")
+	}
+}
@@ -0,0 +1,100 @@
+package pod
+
+import (
+	"time"
+
+	"github.com/avereha/pod/pkg/command"
+)
+
+// BeepSettings are the delivery beeps programmed with 0x1e
+type BeepSettings struct {
+	Basal     command.DeliveryBeeps `toml:"basal"`
+	TempBasal command.DeliveryBeeps `toml:"temp_basal"`
+	Bolus     command.DeliveryBeeps `toml:"bolus"`
+}
+
+// Beep is the data of a beep event
+type Beep struct {
+	Type   command.BeepType
+	Reason string
+}
+
+// The sound of the completion and interval beeps. We do not know which one
+// a real pod plays; the apps only care about when it beeps.
+const deliveryBeep = command.BeepBipBip
+
+func (p *Pod) beep(t command.BeepType, reason string) {
+	p.emitEventData(EventBeep, Beep{Type: t, Reason: reason}, "pod beeped %s: %s", t, reason)
+}
+
+// programBeeps applies a 0x1e command. p.mtx must be held.
+func (p *Pod) programBeeps(c *command.ProgramBeeps) {
+	p.state.Beeps = BeepSettings{
+		Basal:     c.Basal,
+		TempBasal: c.TempBasal,
+		Bolus:     c.Bolus,
+	}
+	if c.BeepType != command.BeepNone && c.BeepType != command.BeepNoneKeepCurrent {
+		p.beep(c.BeepType, "requested")
+	}
+}
+
+// scheduleBeeps arms the completion and interval beeps of the deliveries
+// that are running now, replacing the ones armed before. A beep is also
+// dropped when its delivery was stopped in the meantime. p.mtx must be held.
+func (p *Pod) scheduleBeeps() {
+	p.beepGeneration++
+	now := time.Now()
+	if end := p.state.BolusEnd; end.After(now) {
+		p.armBeeps("bolus", p.state.Beeps.Bolus, now, end, func() bool {
+			return p.state.BolusEnd.Equal(end)
+		})
+	}
+	if end := p.state.TempBasalEnd; end.After(now) {
+		p.armBeeps("temp basal", p.state.Beeps.TempBasal, now, end, func() bool {
+			return p.state.TempBasalEnd.Equal(end)
+		})
+	} else if p.state.BasalActive {
+		// the basal schedule does not end, it only has interval beeps
+		interval := command.DeliveryBeeps{Interval: p.state.Beeps.Basal.Interval}
+		p.armBeeps("basal", interval, now, time.Time{}, func() bool {
+			return p.state.BasalActive
+		})
+	}
+}
+
+// armBeeps arms the beeps of one delivery ending at end, zero for none.
+// running tells whether the delivery still runs, it is called with p.mtx held.
+func (p *Pod) armBeeps(delivery string, beeps command.DeliveryBeeps, now, end time.Time, running func() bool) {
+	generation := p.beepGeneration
+	armed := func() bool {
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		return p.beepGeneration == generation && running()
+	}
+
+	if beeps.Completion && !end.IsZero() {
+		time.AfterFunc(end.Sub(now), func() {
+			if armed() {
+				p.beep(deliveryBeep, delivery+" completed")
+			}
+		})
+	}
+	if beeps.Interval == 0 {
+		return
+	}
+	interval := time.Duration(beeps.Interval) * time.Minute
+	var tick func()
+	tick = func() {
+		if !armed() {
+			return
+		}
+		p.beep(deliveryBeep, delivery+" running")
+		if end.IsZero() || time.Now().Add(interval).Before(end) {
+			time.AfterFunc(interval, tick)
+		}
+	}
+	if end.IsZero() || now.Add(interval).Before(end) {
+		time.AfterFunc(interval, tick)
+	}
+}
@@ -0,0 +1,116 @@
+package pod
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/avereha/pod/pkg/random"
+	log "github.com/sirupsen/logrus"
+)
+
+var errFlakyDisconnect = errors.New("flaky connection")
+
+// connectivity simulates a pod that is out of range, or that the central
+// can only reach some of the time. It is protected by Pod.mtx.
+type connectivity struct {
+	outOfRangeUntil time.Time
+	backInRange     *time.Timer
+	// advertising was paused through the API before going out of range
+	wasPaused bool
+
+	// Part of the sessions, 0 to 1, that are dropped in the middle of a command
+	flakyRate float64
+	// decides which sessions are dropped, created with the first one
+	source *random.Source
+}
+
+// OutOfRange makes the pod unreachable for d: it stops advertising, drops the
+// current connection and refuses new ones until it is back in range.
+func (p *Pod) OutOfRange(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("out of range duration must be positive, got %s", d)
+	}
+	p.mtx.Lock()
+	if p.connectivity.backInRange != nil {
+		p.connectivity.backInRange.Stop()
+	} else {
+		_, paused, _ := p.ble.AdvertisingStatus()
+		p.connectivity.wasPaused = paused
+	}
+	p.connectivity.outOfRangeUntil = time.Now().Add(d)
+	p.connectivity.backInRange = time.AfterFunc(d, p.BackInRange)
+	p.mtx.Unlock()
+
+	p.ble.RefuseConnections(func(central string) {
+		p.emitEvent(EventConnectivity, "refused a connection from %s, out of range", central)
+	})
+	if err := p.ble.PauseAdvertising(); err != nil {
+		log.Warnf("pkg pod; could not stop advertising: %s", err)
+	}
+	p.ble.ShutdownConnection()
+	p.emitEvent(EventConnectivity, "out of range for %s", d)
+	p.notifyStateChange()
+	return nil
+}
+
+// BackInRange ends OutOfRange early
+func (p *Pod) BackInRange() {
+	p.mtx.Lock()
+	if p.connectivity.backInRange == nil {
+		p.mtx.Unlock()
+		return
+	}
+	p.connectivity.backInRange.Stop()
+	p.connectivity.backInRange = nil
+	p.connectivity.outOfRangeUntil = time.Time{}
+	wasPaused := p.connectivity.wasPaused
+	p.mtx.Unlock()
+
+	p.ble.RefuseConnections(nil)
+	if !wasPaused {
+		if err := p.ble.ResumeAdvertising(); err != nil {
+			log.Warnf("pkg pod; could not resume advertising: %s", err)
+		}
+	}
+	p.emitEvent(EventConnectivity, "back in range")
+	p.notifyStateChange()
+}
+
+// SetFlakyConnection drops rate, 0 to 1, of the sessions in the middle of
+// their first command. 0 turns it off.
+func (p *Pod) SetFlakyConnection(rate float64) error {
+	if rate < 0 || rate > 1 {
+		return fmt.Errorf("flaky connection rate must be between 0 and 1, got %g", rate)
+	}
+	p.mtx.Lock()
+	p.connectivity.flakyRate = rate
+	p.mtx.Unlock()
+	if rate == 0 {
+		p.emitEvent(EventConnectivity, "flaky connection off")
+	} else {
+		p.emitEvent(EventConnectivity, "flaky connection, dropping %.0f%% of the sessions", rate*100)
+	}
+	p.notifyStateChange()
+	return nil
+}
+
+// dropThisSession decides at the start of a session whether the flaky
+// connection drops it
+func (p *Pod) dropThisSession() bool {
+	p.mtx.Lock()
+	rate := p.connectivity.flakyRate
+	if rate > 0 && p.connectivity.source == nil {
+		p.connectivity.source = random.NewSource(p.name)
+	}
+	source := p.connectivity.source
+	p.mtx.Unlock()
+	return rate > 0 && source.Float64() < rate
+}
+
+// dropSession closes the connection while the central waits for a response
+func (p *Pod) dropSession(seq uint8) error {
+	p.emitEvent(EventConnectivity, "flaky connection, dropped the session in the middle of message %d", seq)
+	p.ble.ShutdownConnection()
+	return errFlakyDisconnect
+}
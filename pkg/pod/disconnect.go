@@ -0,0 +1,87 @@
+package pod
+
+import (
+	"fmt"
+	"time"
+)
+
+// DisconnectMode selects when the pod closes the connection on its own.
+// Some DASH pods disconnect every few minutes, and Loop can use that as a
+// heartbeat when no BLE CGM is available.
+type DisconnectMode string
+
+const (
+	// Disconnect when no command was received for a while
+	DisconnectIdle DisconnectMode = "idle"
+	// Disconnect at a fixed interval after connecting, regardless of traffic
+	DisconnectInterval DisconnectMode = "interval"
+	// Keep the connection until the central closes it
+	DisconnectNever DisconnectMode = "never"
+)
+
+type DisconnectPolicy struct {
+	Mode  DisconnectMode
+	After time.Duration
+}
+
+var DefaultDisconnectPolicy = DisconnectPolicy{
+	Mode:  DisconnectIdle,
+	After: 1 * time.Minute,
+}
+
+func ParseDisconnectMode(s string) (DisconnectMode, error) {
+	switch m := DisconnectMode(s); m {
+	case DisconnectIdle, DisconnectInterval, DisconnectNever:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown disconnect policy %q. Use one of: idle, interval, never", s)
+}
+
+func (d DisconnectPolicy) Validate() error {
+	if _, err := ParseDisconnectMode(string(d.Mode)); err != nil {
+		return err
+	}
+	if d.Mode != DisconnectNever && d.After <= 0 {
+		return fmt.Errorf("disconnect policy %s needs a positive duration, got %s", d.Mode, d.After)
+	}
+	return nil
+}
+
+func (d DisconnectPolicy) String() string {
+	if d.Mode == DisconnectNever {
+		return string(d.Mode)
+	}
+	return fmt.Sprintf("%s %s", d.Mode, d.After)
+}
+
+// readTimeout returns how long to wait for the next command of a session
+// that started at sessionStart. ok is false when there is no limit.
+func (d DisconnectPolicy) readTimeout(sessionStart time.Time) (timeout time.Duration, ok bool) {
+	switch d.Mode {
+	case DisconnectIdle:
+		return d.After, true
+	case DisconnectInterval:
+		return time.Until(sessionStart.Add(d.After)), true
+	}
+	return 0, false
+}
+
+// delayResponse holds a response back for d, for a delay rule. The session
+// can still end in the meantime: the central disconnects, the pod goes out
+// of range or the interval of the disconnect policy is over.
+func (p *Pod) delayResponse(d time.Duration, sessionStart time.Time) error {
+	if d <= 0 {
+		return nil
+	}
+	p.mtx.Lock()
+	policy := p.disconnectPolicy
+	p.mtx.Unlock()
+	if left, ok := policy.readTimeout(sessionStart); ok && policy.Mode == DisconnectInterval && left < d {
+		if err := p.ble.Sleep(left); err != nil {
+			return err
+		}
+		p.emitEvent(EventForcedDisconnect, "disconnecting after %s, policy: %s", time.Since(sessionStart).Round(time.Second), policy)
+		return fmt.Errorf("%w, policy: %s", errForcedDisconnect, policy)
+	}
+	return p.ble.Sleep(d)
+}
@@ -0,0 +1,56 @@
+package pod
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Event is sent to API clients next to the state updates. Clients can tell
+// them apart from the state by the Event field.
+type Event struct {
+	Event   string
+	Time    time.Time
+	Message string
+	Data    interface{} `json:",omitempty"`
+}
+
+const (
+	EventForcedDisconnect = "forcedDisconnect"
+	EventSnapshots        = "snapshots"
+	EventSnapshotDiff     = "snapshotDiff"
+	EventAdvertising      = "advertising"
+	EventConnectivity     = "connectivity"
+	EventLostResponse     = "lostResponse"
+	EventRules            = "rules"
+	EventRuleFired        = "ruleFired"
+	EventBeep             = "beep"
+	EventAlert            = "alert"
+)
+
+func (p *Pod) emitEvent(name string, format string, args ...interface{}) {
+	p.emitEventData(name, nil, format, args...)
+}
+
+// emitEventData sends an event with a result for the API client
+func (p *Pod) emitEventData(name string, data interface{}, format string, args ...interface{}) {
+	e := &Event{
+		Event:   name,
+		Time:    time.Now(),
+		Message: fmt.Sprintf(format, args...),
+		Data:    data,
+	}
+	log.Infof("pkg pod; event %s: %s", e.Event, e.Message)
+
+	if p.webMessageHook == nil {
+		return
+	}
+	msg, err := json.Marshal(e)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	p.webMessageHook(msg)
+}
@@ -0,0 +1,36 @@
+package pod
+
+import (
+	"time"
+
+	"github.com/avereha/pod/pkg/command"
+)
+
+// How many commands we remember
+const maxHistoryEntries = 500
+
+// HistoryEntry is one command received by the pod, with the pulse counters
+// after handling it
+type HistoryEntry struct {
+	Time      time.Time `toml:"time"`
+	Command   string    `toml:"command"`
+	Seq       uint8     `toml:"seq"`
+	Data      []byte    `toml:"data"`
+	Delivered uint16    `toml:"delivered"`
+	Reservoir uint16    `toml:"reservoir"`
+}
+
+// recordHistory is called with p.mtx held
+func (p *Pod) recordHistory(cmd command.Command, data []byte) {
+	p.history = append(p.history, HistoryEntry{
+		Time:      time.Now(),
+		Command:   commandTypeLabel(cmd.GetType()),
+		Seq:       cmd.GetSeq(),
+		Data:      data,
+		Delivered: p.state.Delivered,
+		Reservoir: p.state.Reservoir,
+	})
+	if len(p.history) > maxHistoryEntries {
+		p.history = p.history[len(p.history)-maxHistoryEntries:]
+	}
+}
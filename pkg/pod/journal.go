@@ -0,0 +1,215 @@
+package pod
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	toml "github.com/pelletier/go-toml"
+	log "github.com/sirupsen/logrus"
+)
+
+// Version of the state file format, see stateMigrations
+const stateSchemaVersion = 2
+
+// The journal is compacted into the state file after this many entries
+const maxJournalEntries = 64
+
+// stateMigrations[v] upgrades a state file from version v to v+1.
+// Files written before the version was added are version 1.
+var stateMigrations = map[int]func(tree *toml.Tree) error{
+	1: func(tree *toml.Tree) error {
+		// PodProgress had no toml tag, and the file name was saved in the file
+		if tree.Has("PodProgress") {
+			tree.Set("pod_progress", tree.Get("PodProgress"))
+			if err := tree.Delete("PodProgress"); err != nil {
+				return err
+			}
+		}
+		if tree.Has("Filename") {
+			return tree.Delete("Filename")
+		}
+		return nil
+	},
+}
+
+func migrateState(tree *toml.Tree) error {
+	version := 1
+	if v, ok := tree.Get("schema_version").(int64); ok {
+		version = int(v)
+	}
+	if version > stateSchemaVersion {
+		return fmt.Errorf("state file version %d is newer than this simulator (version %d)", version, stateSchemaVersion)
+	}
+	for ; version < stateSchemaVersion; version++ {
+		log.Infof("pkg pod; migrating the state file from version %d to %d", version, version+1)
+		if err := stateMigrations[version](tree); err != nil {
+			return fmt.Errorf("could not migrate the state file from version %d: %w", version, err)
+		}
+	}
+	tree.Set("schema_version", int64(stateSchemaVersion))
+	return nil
+}
+
+// stateCounters are the values that change on every message. They are
+// appended to the journal instead of rewriting the whole state file.
+type stateCounters struct {
+	NonceSeq  uint64
+	MsgSeq    uint8
+	CmdSeq    uint8
+	EapAkaSeq uint64
+}
+
+const journalFormat = "generation=%d nonce_seq=%d msg_seq=%d cmd_seq=%d eap_aka_seq=%d\n"
+
+func (p *PODState) counters() stateCounters {
+	return stateCounters{
+		NonceSeq:  p.NonceSeq,
+		MsgSeq:    p.MsgSeq,
+		CmdSeq:    p.CmdSeq,
+		EapAkaSeq: p.EapAkaSeq,
+	}
+}
+
+func (p *PODState) journalFilename() string {
+	return p.Filename + ".journal"
+}
+
+// SaveCounters records the nonce and sequence numbers in the journal. It
+// is much cheaper than Save, and does nothing when they did not change.
+func (p *PODState) SaveCounters() error {
+	c := p.counters()
+	if c == p.journaled {
+		return nil
+	}
+	if p.journalEntries >= maxJournalEntries {
+		return p.Save()
+	}
+	f, err := os.OpenFile(p.journalFilename(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, journalFormat, p.Generation, c.NonceSeq, c.MsgSeq, c.CmdSeq, c.EapAkaSeq)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	p.journaled = c
+	p.journalEntries++
+	return nil
+}
+
+// contents is the state file without the nonce and sequence numbers, to
+// tell whether a message changed more than those. nil when it can not be
+// marshaled.
+func (p *PODState) contents() []byte {
+	c := p.counters()
+	p.NonceSeq, p.MsgSeq, p.CmdSeq, p.EapAkaSeq = 0, 0, 0, 0
+	data, err := toml.Marshal(p)
+	p.NonceSeq, p.MsgSeq, p.CmdSeq, p.EapAkaSeq = c.NonceSeq, c.MsgSeq, c.CmdSeq, c.EapAkaSeq
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// saveMessage saves the state after a message. The state file is only
+// rewritten when the commands changed more than the nonce and sequence
+// numbers, before is the contents from before the message.
+func (p *PODState) saveMessage(before []byte, mutated bool) error {
+	if mutated || before == nil || !bytes.Equal(before, p.contents()) {
+		return p.Save()
+	}
+	return p.SaveCounters()
+}
+
+// replayJournal applies the journal entries written after the state file.
+// Entries from an older state file, and a last line cut by a crash, are skipped.
+func (p *PODState) replayJournal() error {
+	f, err := os.Open(p.journalFilename())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var generation int64
+		var c stateCounters
+		_, err := fmt.Sscanf(scanner.Text()+"\n", journalFormat, &generation, &c.NonceSeq, &c.MsgSeq, &c.CmdSeq, &c.EapAkaSeq)
+		if err != nil {
+			log.Warnf("pkg pod; skipping journal entry %q: %s", scanner.Text(), err)
+			continue
+		}
+		if generation != p.Generation {
+			continue
+		}
+		p.NonceSeq = c.NonceSeq
+		p.MsgSeq = c.MsgSeq
+		p.CmdSeq = c.CmdSeq
+		p.EapAkaSeq = c.EapAkaSeq
+		p.journalEntries++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	p.journaled = p.counters()
+	if p.journalEntries > 0 {
+		log.Infof("pkg pod; replayed %d journal entries, nonce seq: %d", p.journalEntries, p.NonceSeq)
+	}
+	return nil
+}
+
+func (p *PODState) truncateJournal() error {
+	err := os.Truncate(p.journalFilename(), 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// writeFileAtomic writes data to a temporary file next to filename, syncs it
+// and renames it over filename
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(filename)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails once renamed, that is fine
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	// make the rename itself durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,74 @@
+package pod
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/avereha/pod/pkg/command"
+)
+
+// LostResponseMode is how the response to a command gets lost, to test how
+// the app recovers when it does not know whether a command was applied
+type LostResponseMode string
+
+const (
+	LostResponseNone LostResponseMode = ""
+	// The command is not applied, the connection is closed without a response
+	LostResponseNotApplied LostResponseMode = "notApplied"
+	// The command is applied, the response is never sent. The connection stays
+	// up, a retry of the command gets the response.
+	LostResponseDropped LostResponseMode = "dropResponse"
+	// The command is applied, the connection is closed before the response
+	LostResponseDisconnect LostResponseMode = "disconnect"
+	// The command is applied and answered, the ACK from the app is ignored
+	// and the connection closed
+	LostResponseAckIgnored LostResponseMode = "ackIgnored"
+)
+
+var errLostResponse = errors.New("lost response")
+
+func ParseLostResponseMode(s string) (LostResponseMode, error) {
+	switch m := LostResponseMode(s); m {
+	case LostResponseNotApplied, LostResponseDropped, LostResponseDisconnect, LostResponseAckIgnored:
+		return m, nil
+	}
+	return LostResponseNone, fmt.Errorf("unknown lost response mode %q. Use one of: %s, %s, %s, %s", s,
+		LostResponseNotApplied, LostResponseDropped, LostResponseDisconnect, LostResponseAckIgnored)
+}
+
+// LoseNextResponse loses the response to the next command that changes the
+// pod state, like a bolus or a temp basal. LostResponseNone disarms it.
+func (p *Pod) LoseNextResponse(mode LostResponseMode) {
+	p.mtx.Lock()
+	p.lostResponse = mode
+	p.mtx.Unlock()
+	if mode == LostResponseNone {
+		p.emitEvent(EventLostResponse, "the next response will be sent")
+	} else {
+		p.emitEvent(EventLostResponse, "losing the next response: %s", mode)
+	}
+}
+
+// takeLostResponse returns how the response to cmd gets lost. p.mtx must be held.
+func (p *Pod) takeLostResponse(cmd command.Command) LostResponseMode {
+	if p.lostResponse == LostResponseNone || !cmd.DoesMutatePodState() {
+		return LostResponseNone
+	}
+	ret := p.lostResponse
+	p.lostResponse = LostResponseNone
+	return ret
+}
+
+// loseResponse ends the session for the modes that close the connection
+func (p *Pod) loseResponse(mode LostResponseMode, seq uint8) error {
+	switch mode {
+	case LostResponseNotApplied:
+		p.emitEvent(EventLostResponse, "message %d: command not applied, closing the connection", seq)
+	case LostResponseDisconnect:
+		p.emitEvent(EventLostResponse, "message %d: command applied, closing the connection before the response", seq)
+	case LostResponseAckIgnored:
+		p.emitEvent(EventLostResponse, "message %d: ignoring the ACK, closing the connection", seq)
+	}
+	p.ble.ShutdownConnection()
+	return fmt.Errorf("%w: %s", errLostResponse, mode)
+}
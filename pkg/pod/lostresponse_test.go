@@ -0,0 +1,26 @@
+package pod
+
+import (
+	"testing"
+
+	"github.com/avereha/pod/pkg/command"
+)
+
+func TestPod_TakeLostResponse(t *testing.T) {
+	p := &Pod{}
+	p.LoseNextResponse(LostResponseDropped)
+
+	if got := p.takeLostResponse(&command.GetStatus{}); got != LostResponseNone {
+		t.Errorf("status requests should keep their response, got %q", got)
+	}
+	if got := p.takeLostResponse(&command.ProgramInsulin{}); got != LostResponseDropped {
+		t.Errorf("got %q, want %q", got, LostResponseDropped)
+	}
+	if got := p.takeLostResponse(&command.ProgramInsulin{}); got != LostResponseNone {
+		t.Errorf("only the next response should be lost, got %q", got)
+	}
+
+	if _, err := ParseLostResponseMode("crash"); err == nil {
+		t.Errorf("unknown mode should not parse")
+	}
+}
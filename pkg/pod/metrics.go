@@ -0,0 +1,93 @@
+package pod
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/avereha/pod/pkg/bluetooth"
+	"github.com/avereha/pod/pkg/command"
+	"github.com/avereha/pod/pkg/metrics"
+	"github.com/avereha/pod/pkg/response"
+)
+
+var (
+	commandsTotal     = metrics.NewCounterVec("pod_commands_total", "Commands received, by command type.", "pod", "type")
+	responsesTotal    = metrics.NewCounterVec("pod_responses_total", "Responses sent, by response type.", "pod", "type")
+	eapAkaHandshakes  = metrics.NewCounterVec("pod_eap_aka_handshakes_total", "EAP-AKA session establishments.", "pod", "result")
+	readTimeoutsTotal = metrics.NewCounterVec("pod_timeouts_total", "Sessions closed by the idle disconnect policy.", "pod")
+	sessionsEnded     = metrics.NewCounterVec("pod_sessions_ended_total", "Sessions ended, by reason.", "pod", "reason")
+
+	reservoirUnits  = metrics.NewGaugeFuncVec("pod_reservoir_units", "Insulin left in the reservoir, in units.", "pod")
+	deliveredPulses = metrics.NewGaugeFuncVec("pod_delivered_pulses", "Total pulses delivered by the pod.", "pod")
+	podProgress     = metrics.NewGaugeFuncVec("pod_progress", "Pod progress (activation/lifecycle state).", "pod")
+	faultEvent      = metrics.NewGaugeFuncVec("pod_fault_event", "Fault event code, 0 when not faulted.", "pod")
+	faulted         = metrics.NewGaugeFuncVec("pod_faulted", "1 when the pod is faulted.", "pod")
+)
+
+// sessionEndLabel keeps the reason label to a small set of values
+func sessionEndLabel(err error) string {
+	switch {
+	case errors.Is(err, errForcedDisconnect):
+		return "forced_disconnect"
+	case errors.Is(err, errDeactivated):
+		return "deactivated"
+	case errors.Is(err, errFlakyDisconnect):
+		return "flaky_connection"
+	case errors.Is(err, errLostResponse):
+		return "lost_response"
+	case errors.Is(err, bluetooth.ErrDisconnected):
+		return "disconnected"
+	case errors.Is(err, bluetooth.ErrChecksum):
+		return "checksum"
+	case errors.Is(err, bluetooth.ErrUnexpectedCommand):
+		return "unexpected_ble_command"
+	default:
+		return "error"
+	}
+}
+
+// responseTypeLabel is the type byte of rsp, like 0x1d
+func responseTypeLabel(rsp response.Response) string {
+	data, err := rsp.Marshal()
+	if err != nil || len(data) == 0 {
+		return "unknown"
+	}
+	return fmt.Sprintf("0x%02x", data[0])
+}
+
+func commandTypeLabel(t command.Type) string {
+	if name, ok := command.CommandName[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", byte(t))
+}
+
+// registerMetrics exposes the state of p as gauges, labeled with the pod name
+// like the counters.
+func (p *Pod) registerMetrics() {
+	stateGauge := func(gauge *metrics.GaugeFuncVec, value func(state *PODState) float64) {
+		gauge.Set(p.name, func() float64 {
+			p.mtx.Lock()
+			defer p.mtx.Unlock()
+			return value(p.state)
+		})
+	}
+	stateGauge(reservoirUnits, func(state *PODState) float64 {
+		return float64(state.Reservoir) * 0.05
+	})
+	stateGauge(deliveredPulses, func(state *PODState) float64 {
+		return float64(state.Delivered)
+	})
+	stateGauge(podProgress, func(state *PODState) float64 {
+		return float64(state.PodProgress)
+	})
+	stateGauge(faultEvent, func(state *PODState) float64 {
+		return float64(state.FaultEvent)
+	})
+	stateGauge(faulted, func(state *PODState) float64 {
+		if state.FaultEvent != 0 || state.PodProgress == response.PodProgressFault {
+			return 1
+		}
+		return 0
+	})
+}
@@ -2,12 +2,15 @@ package pod
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/avereha/pod/pkg/bluetooth"
 	"github.com/avereha/pod/pkg/command"
 	"github.com/avereha/pod/pkg/eap"
+	"github.com/avereha/pod/pkg/message"
 	"github.com/avereha/pod/pkg/pair"
 
 	"github.com/avereha/pod/pkg/encrypt"
@@ -17,64 +20,114 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-type PodMsgBody struct {
-	// This contains the decrypted message body
-	//   MsgBodyCommand: incoming after stripping off address and crc
-	//   MsgBodyResponse: outgoing before adding address and crc
-	//      not sure how to get this to this level and don't really need it
-	//   DeactivateFlag: set to true once 0x1c input is detected
-	MsgBodyCommand []byte
-	// MsgBodyResponse []byte
-	DeactivateFlag bool
-}
-
 type Pod struct {
+	// name tells the pods of one process apart, it is the bluetooth adapter
+	name           string
 	ble            *bluetooth.Ble
 	state          *PODState
 	mtx            sync.Mutex
 	webMessageHook func([]byte)
-}
 
-// Once one of these are set, the next command will crash the executable.
-var crashBeforeProcessingCommand bool
-var crashAfterProcessingCommand bool
+	// Include LTK and session keys in the published state. Debugging only.
+	exposeKeys bool
 
-func New(ble *bluetooth.Ble, stateFile string, freshState bool) *Pod {
-	var err error
+	lastSessionEnd   time.Time
+	lastSessionError string
 
-	state := &PODState{
-		Reservoir:      150 / 0.05,
-		ActivationTime: time.Now(),
-		Filename:       stateFile,
-	}
-	if !freshState {
-		state, err = NewState(stateFile)
-		if err != nil {
-			log.Fatalf("pkg pod; could not restore pod state from %s: %+v", stateFile, err)
-		}
-	}
+	disconnectPolicy DisconnectPolicy
+
+	history []HistoryEntry
+
+	// reported in the version responses, nil for the default version
+	version *response.PodVersion
+
+	connectivity connectivity
+
+	// how the response to the next command that changes the state gets lost
+	lostResponse LostResponseMode
+
+	rules []*Rule
+
+	// bumped to drop the beeps armed for the deliveries before
+	beepGeneration int
+}
 
+var (
+	errForcedDisconnect = errors.New("forced disconnect")
+	errDeactivated      = errors.New("pod deactivated")
+)
+
+// How many challenges we take in one session when the app is resynchronizing the SQN
+const maxEapAkaSyncAttempts = 3
+
+// New starts the pod with state, restored with NewState or made with
+// NewFreshState
+func New(ble *bluetooth.Ble, state *PODState) *Pod {
 	ret := &Pod{
-		ble:   ble,
-		state: state,
+		name:             ble.Adapter(),
+		ble:              ble,
+		state:            state,
+		disconnectPolicy: DefaultDisconnectPolicy,
 	}
+	ret.registerMetrics()
+	ret.updateAdvertising()
+	ret.scheduleBeeps()
+	ret.scheduleAlerts()
 
 	return ret
 }
 
+// Name is the bluetooth adapter of the pod
+func (p *Pod) Name() string {
+	return p.name
+}
+
 func (p *Pod) SetWebMessageHook(hook func([]byte)) {
 	p.webMessageHook = hook
 }
 
+// SetVersion sets the firmware versions, lot and TID the pod reports
+func (p *Pod) SetVersion(version response.PodVersion) {
+	p.mtx.Lock()
+	p.version = &version
+	p.mtx.Unlock()
+}
+
+func (p *Pod) SetExposeKeys(expose bool) {
+	if expose {
+		log.Warnf("pkg pod; LTK and session keys will be sent to API clients")
+	}
+	p.mtx.Lock()
+	p.exposeKeys = expose
+	p.mtx.Unlock()
+}
+
 func (p *Pod) GetPodStateJson() ([]byte, error) {
 	p.mtx.Lock()
-	data, error := json.Marshal(p.state)
+	p.state.updateActivation(time.Now())
+	view := newPodStateView(p.state, p.exposeKeys)
+	view.Name = p.name
+	view.LastSessionEnd = p.lastSessionEnd
+	view.LastSessionError = p.lastSessionError
+	view.DisconnectPolicy = p.disconnectPolicy.String()
+	view.OutOfRangeUntil = p.connectivity.outOfRangeUntil
+	view.FlakyConnectionRate = p.connectivity.flakyRate
+	if p.ble != nil {
+		a, paused, interval := p.ble.AdvertisingStatus()
+		view.Advertising = a.State.String()
+		if paused {
+			view.Advertising = "paused"
+		}
+		view.AdvertisingIntervalMs = float64(interval) / float64(time.Millisecond)
+	}
+	data, error := json.Marshal(view)
 	p.mtx.Unlock()
 
 	return data, error
 }
 
 func (p *Pod) notifyStateChange() {
+	p.updateAdvertising()
 	if p.webMessageHook != nil {
 		data, err := p.GetPodStateJson()
 		if err != nil {
@@ -87,98 +140,248 @@ func (p *Pod) notifyStateChange() {
 	}
 }
 
+// StartAcceptingCommands runs one session after the other. A session ends
+// when the central disconnects or anything goes wrong talking to it; the
+// connection is then closed and the pod goes back to advertising and waiting
+// for the next one.
 func (p *Pod) StartAcceptingCommands() {
+	for {
+		err := p.runSession()
+		p.endSession(err)
+	}
+}
+
+func (p *Pod) runSession() error {
 	log.Infof("pkg pod; Listening for commands")
 	firstCmd, _ := p.ble.ReadCmd()
 	log.Infof("pkg pod; got first command: as string: %s", firstCmd)
 
 	p.ble.StartMessageLoop()
 
-	if p.state.LTK != nil { // paired, just establish new session
-		p.EapAka()
+	msg, err := p.ble.ReadMessage()
+	if err != nil {
+		return err
+	}
+	switch msg.Type {
+	case message.MessageTypePairing: // get the LTK
+		if err := p.checkPairingAllowed(); err != nil {
+			return err
+		}
+		return p.StartActivation(msg)
+	case message.MessageTypeSessionEstablishment: // paired, just establish new session
+		p.mtx.Lock()
+		paired := p.state.LTK != nil
+		p.mtx.Unlock()
+		if !paired {
+			return errors.New("the app wants an EAP-AKA session, but the pod is not paired")
+		}
+		return p.EapAka(msg)
+	}
+	return fmt.Errorf("unexpected message type %d to start a session", msg.Type)
+}
+
+// checkPairingAllowed lets a pod pair again with a new controller, as long as
+// it was not activated past PodProgressPairingCompleted
+func (p *Pod) checkPairingAllowed() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.state.LTK == nil {
+		return nil
+	}
+	if p.state.PodProgress > response.PodProgressPairingCompleted {
+		return fmt.Errorf("pod is already activated, pod progress: %d. Refusing to pair again", p.state.PodProgress)
+	}
+	log.Infof("pkg pod; pod is paired but not activated, pairing again")
+	return nil
+}
+
+// endSession closes the connection and records why the session ended
+func (p *Pod) endSession(err error) {
+	reason := "unknown"
+	if err != nil {
+		reason = err.Error()
+	}
+	if errors.Is(err, errForcedDisconnect) || errors.Is(err, bluetooth.ErrDisconnected) || errors.Is(err, errDeactivated) ||
+		errors.Is(err, errFlakyDisconnect) || errors.Is(err, errLostResponse) {
+		log.Infof("pkg pod; session ended: %s", reason)
 	} else {
-		p.StartActivation() // not paired, get the LTK
+		log.Errorf("pkg pod; session ended: %s", reason)
 	}
+	sessionsEnded.Inc(p.name, sessionEndLabel(err))
+
+	p.ble.ShutdownConnection()
+	p.ble.StopMessageLoop()
+
+	p.mtx.Lock()
+	p.lastSessionEnd = time.Now()
+	p.lastSessionError = reason
+	if err := p.state.Save(); err != nil {
+		log.Errorf("pkg pod; could not save the pod state: %s", err)
+	}
+	p.mtx.Unlock()
+
+	p.notifyStateChange()
 }
 
-func (p *Pod) StartActivation() {
+// StartActivation pairs with the app. msg is the first pairing message, SP1SP2
+func (p *Pod) StartActivation(msg *message.Message) error {
 
 	pair := &pair.Pair{}
-	msg, _ := p.ble.ReadMessage()
 	if err := pair.ParseSP1SP2(msg); err != nil {
-		log.Fatalf("pkg pod;  pkg pod; error parsing SP1SP2 %s", err)
+		return fmt.Errorf("error parsing SP1SP2: %w", err)
 	}
 	// read PDM public key and nonce
-	msg, _ = p.ble.ReadMessage()
+	msg, err := p.ble.ReadMessage()
+	if err != nil {
+		return err
+	}
 	if err := pair.ParseSPS1(msg); err != nil {
-		log.Fatalf("pkg pod; error parsing SPS1 %s", err)
+		return fmt.Errorf("error parsing SPS1: %w", err)
 	}
 
-	msg, err := pair.GenerateSPS1()
+	msg, err = pair.GenerateSPS1()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	// send POD public key and nonce
-	p.ble.WriteMessage(msg)
+	if err := p.ble.WriteMessage(msg); err != nil {
+		return err
+	}
 
 	// read PDM conf value
-	msg, _ = p.ble.ReadMessage()
-	pair.ParseSPS2(msg)
+	msg, err = p.ble.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if err := pair.ParseSPS2(msg); err != nil {
+		return fmt.Errorf("pairing aborted: %w", err)
+	}
 
 	// send POD conf value
 	msg, err = pair.GenerateSPS2()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if err := p.ble.WriteMessage(msg); err != nil {
+		return err
 	}
-	p.ble.WriteMessage(msg)
 
 	// receive SP0GP0 constant from PDM
-	msg, _ = p.ble.ReadMessage()
+	msg, err = p.ble.ReadMessage()
+	if err != nil {
+		return err
+	}
 	err = pair.ParseSP0GP0(msg)
 	if err != nil {
-		log.Fatalf("pkg pod; could not parse SP0GP0: %s", err)
+		return fmt.Errorf("could not parse SP0GP0: %w", err)
 	}
 
 	// send P0 constant
 	msg, err = pair.GenerateP0()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if err := p.ble.WriteMessage(msg); err != nil {
+		return err
 	}
-	p.ble.WriteMessage(msg)
 
-	p.state.LTK, err = pair.LTK()
+	ltk, err := pair.LTK()
 	if err != nil {
-		log.Fatalf("pkg pod; could not get LTK %s", err)
+		return fmt.Errorf("could not get LTK: %w", err)
 	}
+
+	p.mtx.Lock()
+	p.state.LTK = ltk
 	log.Infof("pkg pod; LTK %x", p.state.LTK)
 	p.state.EapAkaSeq = 1
-	p.state.Save()
+	// keys of a previous pairing are useless now
+	p.state.CK = nil
+	p.state.NoncePrefix = nil
+	p.state.NonceSeq = 0
+	err = p.state.Save()
+	p.mtx.Unlock()
+	if err != nil {
+		return fmt.Errorf("could not save the pod state: %w", err)
+	}
 
-	p.EapAka()
+	msg, err = p.ble.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return p.EapAka(msg)
 }
 
-func (p *Pod) EapAka() {
-
-	session := eap.NewEapAkaChallenge(p.state.LTK, p.state.EapAkaSeq)
+// EapAka establishes a session key. msg is the EAP-AKA challenge
+func (p *Pod) EapAka(msg *message.Message) error {
 
-	msg, _ := p.ble.ReadMessage()
-	err := session.ParseChallenge(msg)
+	session, err := eap.NewEapAkaChallenge(p.state.LTK, p.state.EapAkaSeq)
 	if err != nil {
-		log.Fatalf("pkg pod; error parsing the EAP-AKA challenge: %s", err)
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			msg, err = p.ble.ReadMessage()
+			if err != nil {
+				return err
+			}
+		}
+		err = session.ParseChallenge(msg)
+		if err != nil {
+			eapAkaHandshakes.Inc(p.name, "failure")
+			return fmt.Errorf("error parsing the EAP-AKA challenge: %w", err)
+		}
+		err = session.CheckAutn()
+		if err == nil {
+			break
+		}
+		if errors.Is(err, eap.ErrSqnOutOfRange) && attempt < maxEapAkaSyncAttempts {
+			// the app resynchronizes and sends a new challenge
+			log.Warnf("pkg pod; %s. Sending AKA-Synchronization-Failure", err)
+			eapAkaHandshakes.Inc(p.name, "sync_failure")
+			msg, err = session.GenerateSynchronizationFailure()
+			if err != nil {
+				return fmt.Errorf("error generating the EAP-AKA synchronization failure: %w", err)
+			}
+			if err := p.ble.WriteMessage(msg); err != nil {
+				return err
+			}
+			continue
+		}
+		eapAkaHandshakes.Inc(p.name, "failure")
+		log.Warnf("pkg pod; %s. Sending AKA-Authentication-Reject", err)
+		msg, rejectErr := session.GenerateAuthenticationReject()
+		if rejectErr != nil {
+			return fmt.Errorf("error generating the EAP-AKA authentication reject: %w", rejectErr)
+		}
+		if writeErr := p.ble.WriteMessage(msg); writeErr != nil {
+			return writeErr
+		}
+		return fmt.Errorf("EAP-AKA challenge rejected: %w", err)
 	}
 
 	msg, err = session.GenerateChallengeResponse()
 	if err != nil {
-		log.Fatalf("pkg pod; error generating the eap-aka challenge response")
+		eapAkaHandshakes.Inc(p.name, "failure")
+		return fmt.Errorf("error generating the EAP-AKA challenge response: %w", err)
+	}
+	if err := p.ble.WriteMessage(msg); err != nil {
+		return err
 	}
-	p.ble.WriteMessage(msg)
 
-	msg, _ = p.ble.ReadMessage()
+	msg, err = p.ble.ReadMessage()
+	if err != nil {
+		return err
+	}
 	log.Debugf("pkg pod; success? %x", msg.Payload) // TODO: figure out how error looks like
 	err = session.ParseSuccess(msg)
 	if err != nil {
-		log.Fatalf("pkg pod; error parsing the EAP-AKA Success packet: %s", err)
+		eapAkaHandshakes.Inc(p.name, "failure")
+		return fmt.Errorf("error parsing the EAP-AKA Success packet: %w", err)
 	}
+	eapAkaHandshakes.Inc(p.name, "success")
+
+	p.mtx.Lock()
 	p.state.CK, p.state.NoncePrefix = session.CKNoncePrefix()
 
 	p.state.NonceSeq = 1
@@ -190,151 +393,295 @@ func (p *Pod) EapAka() {
 	log.Infof("pkg pod; EAP-AKA session SQN: %d", p.state.EapAkaSeq)
 
 	err = p.state.Save()
+	p.mtx.Unlock()
 	if err != nil {
-		log.Fatalf("pkg pod; Could not save the pod state: %s", err)
+		return fmt.Errorf("could not save the pod state: %w", err)
 	}
 
-	// initialize pMsg
-	var pMsg PodMsgBody
-	pMsg.MsgBodyCommand = make([]byte, 16)
-	pMsg.DeactivateFlag = false
-	log.Tracef("pkd pod; pMsg initialized: %+v", pMsg)
-
-	p.CommandLoop(pMsg)
+	return p.CommandLoop()
 }
 
-func (p *Pod) CommandLoop(pMsg PodMsgBody) {
-	var lastMsgSeq uint8 = 0
-	var data []byte = make([]byte, 4)
-	var n int = 0
+func (p *Pod) CommandLoop() error {
+	var exchange message.Exchange
+	var sessionStart = time.Now()
+	var drop = p.dropThisSession()
+	var ignoreAck bool
+	var deactivated bool
+	var lastResponseType string
 	for {
-		if pMsg.DeactivateFlag {
+		if deactivated && !exchange.WaitingForAck() {
+			// the pod keeps advertising as inactive, it can not be paired again
 			log.Infof("pkg pod; Pod was deactivated. Use -fresh for new pod")
-			time.Sleep(1 * time.Second)
-			log.Exit(0)
+			return errDeactivated
 		}
 		log.Infof("pkg pod;   *** Waiting for the next command ***")
-		msg, didTimeout := p.ble.ReadMessageWithTimeout(1 * time.Minute)
-		if didTimeout {
-			p.ble.ShutdownConnection()
-			go func() {
-				p.StartAcceptingCommands()
-			}()
-			return
+		p.mtx.Lock()
+		policy := p.disconnectPolicy
+		p.mtx.Unlock()
+
+		var msg *message.Message
+		var err error
+		if timeout, ok := policy.readTimeout(sessionStart); !ok {
+			msg, err = p.ble.ReadMessage()
+		} else if timeout > 0 {
+			msg, err = p.ble.ReadMessageWithTimeout(timeout)
+		} else {
+			err = bluetooth.ErrReadTimeout
+		}
+		if errors.Is(err, bluetooth.ErrReadTimeout) {
+			if policy.Mode == DisconnectIdle {
+				readTimeoutsTotal.Inc(p.name)
+			}
+			p.emitEvent(EventForcedDisconnect, "disconnecting after %s, policy: %s", time.Since(sessionStart).Round(time.Second), policy)
+			return fmt.Errorf("%w, policy: %s", errForcedDisconnect, policy)
+		}
+		if err != nil {
+			return err
 		}
 		log.Tracef("pkg pod; got command message: %s", spew.Sdump(msg))
+		if ignoreAck {
+			return p.loseResponse(LostResponseAckIgnored, msg.SequenceNumber)
+		}
 
-		if msg.SequenceNumber == lastMsgSeq {
-			// this is a retry because we did not answer yet
-			// ignore duplicate commands/mesages
+		if exchange.IsDuplicate(msg) {
+			// a retry, the central did not get our response
+			if rsp := exchange.LastResponse(); rsp != nil {
+				log.Infof("pkg pod; duplicate message %d, sending the last response again", msg.SequenceNumber)
+				if err := p.ble.WriteMessage(rsp); err != nil {
+					return err
+				}
+				responsesTotal.Inc(p.name, lastResponseType)
+			} else {
+				log.Debugf("pkg pod; ignoring duplicate message %d", msg.SequenceNumber)
+			}
 			continue
 		}
-		lastMsgSeq = msg.SequenceNumber
-
-		// Lock mutex before we start using/modifying state
-		p.mtx.Lock()
-
-		decrypted, err := encrypt.DecryptMessage(p.state.CK, p.state.NoncePrefix, p.state.NonceSeq, msg)
-		if err != nil {
-			log.Fatalf("pkg pod; could not decrypt message: %s", err)
+		if drop {
+			return p.dropSession(msg.SequenceNumber)
+		}
+		if !exchange.IsInSequence(msg) {
+			log.Warnf("pkg pod; message sequence number %d is out of sequence", msg.SequenceNumber)
+		}
+		if err := exchange.Received(msg); err != nil {
+			return err
 		}
-		p.state.NonceSeq++
 
-		cmd, err := command.Unmarshal(decrypted.Payload)
+		rsp, reaction, err := p.handleMessage(msg)
 		if err != nil {
-			log.Fatalf("pkg pod; could not unmarshal command: %s", err)
+			return err
 		}
-		cmdSeq, requestID, err := cmd.GetHeaderData()
-		if err != nil {
-			log.Fatalf("pkg pod; could not get command header data: %s", err)
+		deactivated = deactivated || reaction.deactivated
+		lost := reaction.lost
+		if lost == LostResponseNotApplied {
+			return p.loseResponse(lost, msg.SequenceNumber)
 		}
-		p.state.CmdSeq = cmdSeq
-
-		log.Debugf("pkd pod; cmd: %x", decrypted.Payload)
-		data = decrypted.Payload
-		n = len(data)
-		log.Debugf("pkg pod; len = %d", n)
-		if n < 16 {
-			log.Fatalf("pkg pod; decrypted. Payload too short")
+		if rsp == nil {
+			continue // just an ACK
 		}
-		pMsg.MsgBodyCommand = data[13 : n-5]
-		if data[13] == 0x1c {
-			pMsg.DeactivateFlag = true
+		if r := reaction.rule; r != nil {
+			p.emitEventData(EventRuleFired, r, "rule %s fired on message %d, action: %s", r.Name, msg.SequenceNumber, r.Action)
+		}
+		if err := p.delayResponse(reaction.delay, sessionStart); err != nil {
+			return err
+		}
+		exchange.Sent(rsp)
+		lastResponseType = reaction.responseType
+		switch lost {
+		case LostResponseDropped:
+			p.emitEvent(EventLostResponse, "message %d: command applied, dropping the response", msg.SequenceNumber)
+		case LostResponseDisconnect:
+			// closed below, once the API clients have the new state
+		default:
+			if err := p.ble.WriteMessage(rsp); err != nil {
+				return err
+			}
+			responsesTotal.Inc(p.name, reaction.responseType)
 		}
-		log.Tracef("pkg pod; command pod message body = %x", pMsg.MsgBodyCommand)
 
-		p.handleCommand(cmd)
+		log.Debugf("notifyingStateChange")
+		p.notifyStateChange()
 
-		var rsp response.Response
-		if cmd.IsResponseHardcoded() {
-			rsp, err = cmd.GetResponse()
-			if err != nil {
-				log.Fatalf("pkg pod; could not get command response: %s", err)
+		switch lost {
+		case LostResponseDisconnect:
+			return p.loseResponse(lost, msg.SequenceNumber)
+		case LostResponseAckIgnored:
+			ignoreAck = true
+		}
+	}
+}
+
+// handleMessage decrypts one message from the central. ACKs without a command
+// are only decrypted. The commands of the message are handled in order and
+// the encrypted response to the last one is returned, with what happens to it
+// when LoseNextResponse is armed or a rule fires. A rule that answers with an
+// error or a fault stops the commands after it. The nonce and sequence numbers
+// are saved before returning, also on errors.
+func (p *Pod) handleMessage(msg *message.Message) (_ *message.Message, _ reaction, err error) {
+	// Lock mutex before we start using/modifying state
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	defer func() {
+		if saveErr := p.state.SaveCounters(); saveErr != nil {
+			if err == nil {
+				err = fmt.Errorf("could not save the nonce seq: %w", saveErr)
+			} else {
+				log.Errorf("pkg pod; could not save the nonce seq: %s", saveErr)
 			}
-		} else {
-			rsp = p.getResponse(cmd)
 		}
+	}()
+	before := p.state.contents()
+
+	decrypted, err := encrypt.DecryptMessage(p.state.CK, p.state.NoncePrefix, p.state.NonceSeq, msg)
+	if err != nil {
+		return nil, reaction{}, fmt.Errorf("could not decrypt message: %w", err)
+	}
+	p.state.NonceSeq++
+	p.state.updateActivation(time.Now())
 
-		if cmd.GetType() == command.SET_UNIQUE_ID {
-			// Set the unique ID
-			log.Tracef("SET_UNIQUE_ID cmd.GetPayload() %@", cmd.GetPayload())
-			uniqueId := cmd.GetPayload()
-			log.Tracef("SET_UNIQUE_ID uniqueId %@", uniqueId)
-			p.ble.RefreshAdvertisingWithSpecifiedId(uniqueId)
-			p.state.Id = uniqueId
+	if len(decrypted.Payload) == 0 {
+		if !msg.Ack {
+			log.Warnf("pkg pod; empty message without the ACK flag: %s", spew.Sdump(msg))
 		}
+		log.Debugf("pkg pod; got ACK %d", msg.AckNumber)
+		return nil, reaction{}, nil
+	}
 
-		switch c := cmd.(type) {
-		case *command.StopDelivery:
-			// Need to clear BolusEnd *after* response is generated, as it is used
-			// to calculate remaining
-			if c.StopBolus {
-				p.state.BolusEnd = time.Time{}
-			}
+	cmds, err := command.Unmarshal(decrypted.Payload)
+	if err != nil {
+		return nil, reaction{}, fmt.Errorf("could not unmarshal command: %w", err)
+	}
+	for _, cmd := range cmds {
+		commandsTotal.Inc(p.name, commandTypeLabel(cmd.GetType()))
+	}
+	cmdSeq, requestID, err := cmds[0].GetHeaderData()
+	if err != nil {
+		return nil, reaction{}, fmt.Errorf("could not get command header data: %w", err)
+	}
+	p.state.CmdSeq = cmdSeq
+	lost := LostResponseNone
+	for _, cmd := range cmds {
+		if lost = p.takeLostResponse(cmd); lost != LostResponseNone {
+			break
 		}
+	}
+	if lost == LostResponseNotApplied {
+		return nil, reaction{lost: lost}, nil
+	}
+	log.Debugf("pkd pod; cmd: %x", decrypted.Payload)
 
-		p.state.MsgSeq++
-		p.state.CmdSeq++
-		p.state.Save()
-		responseMetadata := &response.ResponseMetadata{
-			Dst:       msg.Source,
-			Src:       msg.Destination,
-			CmdSeq:    p.state.CmdSeq,
-			MsgSeq:    p.state.MsgSeq,
-			RequestID: requestID,
-			AckSeq:    msg.SequenceNumber + 1,
+	var rsp response.Response
+	var rule *Rule
+	var deactivated bool
+	for _, cmd := range cmds {
+		if lost == LostResponseNone && rule == nil {
+			rule = p.matchRule(cmd)
 		}
-		msg, err = response.Marshal(rsp, responseMetadata)
-		if err != nil {
-			log.Fatalf("pkg pod; could not marshal command response: %s", err)
+		if rule != nil && rule.Action == RuleError {
+			// not applied
+			rsp = &response.NackResponse{
+				ErrorCode:   rule.ErrorCode,
+				FaultEvent:  p.state.FaultEvent,
+				PodProgress: p.state.PodProgress,
+			}
+			break
+		}
+		if rule != nil && rule.Action == RuleFault {
+			// a faulted pod does not apply the command
+			p.setFault(uint8(rule.Fault))
+			rsp = p.makeDetailedStatusResponse()
+			break
 		}
-		msg, err = encrypt.EncryptMessage(p.state.CK, p.state.NoncePrefix, p.state.NonceSeq, msg)
+		rsp, err = p.applyCommand(cmd, decrypted.Payload)
 		if err != nil {
-			log.Fatalf("pkg pod; could not encrypt response: %s", err)
+			return nil, reaction{}, err
 		}
-		p.state.NonceSeq++
-		p.state.Save()
+		deactivated = deactivated || cmd.GetType() == command.DEACTIVATE
+	}
+	if rule != nil && rule.Action == RuleStatus {
+		overrideStatus(rsp, rule.Status)
+	}
+
+	p.state.MsgSeq++
+	p.state.CmdSeq++
+	mutated := false
+	for _, cmd := range cmds {
+		mutated = mutated || cmd.DoesMutatePodState()
+	}
+	if err := p.state.saveMessage(before, mutated); err != nil {
+		return nil, reaction{}, fmt.Errorf("could not save the pod state: %w", err)
+	}
+	responseMetadata := &response.ResponseMetadata{
+		Dst:       msg.Source,
+		Src:       msg.Destination,
+		CmdSeq:    p.state.CmdSeq,
+		MsgSeq:    p.state.MsgSeq,
+		RequestID: requestID,
+		AckSeq:    msg.SequenceNumber + 1,
+	}
+	msg, err = response.Marshal(rsp, responseMetadata)
+	if err != nil {
+		return nil, reaction{}, fmt.Errorf("could not marshal command response: %w", err)
+	}
+	msg, err = encrypt.EncryptMessage(p.state.CK, p.state.NoncePrefix, p.state.NonceSeq, msg)
+	if err != nil {
+		return nil, reaction{}, fmt.Errorf("could not encrypt response: %w", err)
+	}
+	p.state.NonceSeq++
+	// the nonce has to be on disk before the app can see it used
+	if err := p.state.SaveCounters(); err != nil {
+		return nil, reaction{}, fmt.Errorf("could not save the nonce seq: %w", err)
+	}
+
+	log.Tracef("pkg pod; sending response: %s", spew.Sdump(msg))
+	ret := reaction{lost: lost}
+	if rule != nil {
+		ret = ruleReaction(rule)
+	}
+	ret.deactivated = deactivated
+	ret.responseType = responseTypeLabel(rsp)
+	return msg, ret, nil
+}
 
-		log.Tracef("pkg pod; sending response: %s", spew.Sdump(msg))
-		p.ble.WriteMessage(msg)
+// applyCommand handles one command and returns the response the pod gives
+// to it. p.mtx must be held.
+func (p *Pod) applyCommand(cmd command.Command, data []byte) (response.Response, error) {
+	p.handleCommand(cmd)
+	p.recordHistory(cmd, data)
 
-		log.Debugf("pkg pod; reading response ACK. Nonce seq %d", p.state.NonceSeq)
-		msg, _ = p.ble.ReadMessage()
-		// TODO check for SEQ numbers here and the Ack flag
-		decrypted, err = encrypt.DecryptMessage(p.state.CK, p.state.NoncePrefix, p.state.NonceSeq, msg)
+	var rsp response.Response
+	if cmd.IsResponseHardcoded() {
+		var err error
+		rsp, err = cmd.GetResponse()
 		if err != nil {
-			log.Fatalf("pkg pod; could not decrypt message: %s", err)
-		}
-		p.state.NonceSeq++
-		if len(decrypted.Payload) != 0 {
-			log.Fatalf("pkg pod; this should be empty message with ACK header %s", spew.Sdump(msg))
+			return nil, fmt.Errorf("could not get command response: %w", err)
 		}
-		p.state.Save()
-		p.mtx.Unlock()
+	} else {
+		rsp = p.getResponse(cmd)
+	}
+	if cmd.GetType() == command.SET_UNIQUE_ID {
+		// Set the unique ID
+		uniqueId := cmd.GetPayload()
+		log.Tracef("SET_UNIQUE_ID uniqueId %x", uniqueId)
+		// advertised once the state change is notified
+		p.state.Id = uniqueId
+	}
 
-		log.Debugf("notifyingStateChange")
-		p.notifyStateChange()
+	// the version responses report the id the app assigned, once it did
+	var id []byte
+	if len(p.state.Id) == 4 {
+		id = p.state.Id
+	}
+	switch r := rsp.(type) {
+	case *response.VersionResponse:
+		r.Version = p.version
+		r.PodProgress = p.state.PodProgress
+		r.PodID = id
+	case *response.SetUniqueID:
+		r.Version = p.version
+		r.PodProgress = p.state.PodProgress
+		r.PodID = id
 	}
+	return rsp, nil
 }
 
 func (p *Pod) makeGeneralStatusResponse() response.Response {
@@ -354,8 +701,9 @@ func (p *Pod) makeGeneralStatusResponse() response.Response {
 		ExtendedBolusActive: p.state.ExtendedBolusActive,
 		PodProgress:         p.state.PodProgress,
 		Delivered:           p.state.Delivered,
-		BolusRemaining:      p.state.BolusRemaining(),
+		BolusRemaining:      p.state.bolusNotDelivered(),
 		MinutesActive:       p.state.MinutesActive(),
+		IsFaulted:           p.state.FaultEvent != 0,
 	}
 }
 
@@ -375,6 +723,7 @@ func (p *Pod) makeDetailedStatusResponse() response.Response {
 		ExtendedBolusActive: p.state.ExtendedBolusActive,
 		PodProgress:         p.state.PodProgress,
 		Delivered:           p.state.Delivered,
+		BolusRemaining:      p.state.bolusNotDelivered(),
 		MinutesActive:       p.state.MinutesActive(),
 		FaultEvent:          p.state.FaultEvent,
 		FaultEventTime:      p.state.FaultTime,
@@ -394,80 +743,123 @@ func (p *Pod) getResponse(cmd command.Command) response.Response {
 	return rsp
 }
 
+// faultedPodApplies tells the commands a faulted pod still applies. It can
+// be asked for its status, have its alerts silenced and be deactivated; the
+// other commands are answered with the detailed status and not applied.
+func faultedPodApplies(cmd command.Command) bool {
+	switch cmd.(type) {
+	case *command.GetStatus, *command.GetVersion, *command.SilenceAlerts, *command.Deactivate:
+		return true
+	}
+	return false
+}
+
 func (p *Pod) handleCommand(cmd command.Command) {
+	if p.state.FaultEvent != 0 && !faultedPodApplies(cmd) {
+		log.Infof("pkg pod; faulted with %s, not applying %s", response.FaultName(p.state.FaultEvent), commandTypeLabel(cmd.GetType()))
+		return
+	}
 	switch c := cmd.(type) {
 	case *command.GetVersion:
-		p.state.PodProgress = response.PodProgressReminderInitialized
+		if p.state.PodProgress < response.PodProgressReminderInitialized {
+			p.state.PodProgress = response.PodProgressReminderInitialized
+		}
 	case *command.SetUniqueID:
-		p.state.PodProgress = response.PodProgressPairingCompleted
+		p.state.paired(time.Now())
+	case *command.CnfgDelivFlag:
+		log.Infof("pkg pod; delivery flags: %s, 0x6x faults enabled: %t", c.Flags, c.Flags.Faults6xEnabled())
+		flags := c.Flags
+		p.state.DeliveryFlags = &flags
 	case *command.ProgramInsulin:
-		if crashBeforeProcessingCommand {
-			log.Fatalf("pkg pod; Crashing before processing command with sequence %d", c.GetSeq())
-		}
 		log.Debugf("pkg pod; ProgramInsulin: PodProgress = %d", p.state.PodProgress)
 
-		if p.state.PodProgress < response.PodProgressPriming {
-			// this must be the prime command
-			p.state.PodProgress = response.PodProgressPriming
-		} else if p.state.PodProgress < response.PodProgressBasalInitialized {
-			// this must be the program scheduled basal command
-			p.state.PodProgress = response.PodProgressBasalInitialized
-		} else if p.state.PodProgress < response.PodProgressInsertingCannula {
-			// this must be the insert cannula command
-			p.state.PodProgress = response.PodProgressInsertingCannula
-		} else if p.state.PodProgress < response.PodProgressRunningAbove50U {
-			p.state.PodProgress = response.PodProgressRunningAbove50U
+		// prime and cannula insertion are told apart from boluses by their size
+		if p.state.startActivationBolus(c, time.Now()) {
+			break
 		}
 
 		// Programming basal schedule
 		if c.TableNum == 0 {
+			if p.state.PodProgress == response.PodProgressPrimingCompleted {
+				p.state.PodProgress = response.PodProgressBasalInitialized
+			}
+			if !p.state.SuspendedAt.IsZero() {
+				log.Infof("pkg pod; delivery resumed")
+				p.state.SuspendedAt = time.Time{}
+			}
 			p.state.BasalActive = true
+			p.state.BasalSchedule = c.Schedule
+			// Duration is the current half hour segment here; the pod's midnight is
+			// the start of that segment minus the segments before it
+			elapsed := time.Duration(c.Duration+1)*30*time.Minute - time.Duration(c.SecondsRemaining)*time.Second
+			p.state.BasalScheduleStart = time.Now().Add(-elapsed)
 		}
 
 		// Programming temp basal
 		if c.TableNum == 1 {
 			p.state.TempBasalEnd = time.Now().Add(time.Duration(c.Duration) * time.Hour / 2)
+			if len(c.Schedule) > 0 {
+				p.state.TempBasalPulses = c.Schedule[0]
+			}
 		}
 
 		// Programming bolus; just immediately decrement reservoir
 		// Would be nice to eventually simulate actual pulses over time.
 		if c.TableNum == 2 {
-			p.state.Delivered += c.Pulses
-			p.state.Reservoir -= c.Pulses
-			p.state.BolusEnd = time.Now().Add(time.Duration(c.Pulses) * time.Second * 2)
-		}
-
-		if crashAfterProcessingCommand {
-			p.state.LastProgSeqNum = cmd.GetSeq() // Normally this happens below, but we do it here in this special case
-			p.state.Save()
-			log.Fatalf("pkg pod; Crashing after processing command with sequence %d", c.GetSeq())
+			p.state.BolusNotDelivered = 0
+			pulses := p.state.takeFromReservoir(c.Pulses)
+			p.state.BolusEnd = time.Now().Add(time.Duration(pulses) * time.Second * 2)
 		}
 
-	case *command.GetStatus:
-		if p.state.PodProgress == response.PodProgressInsertingCannula {
-			p.state.PodProgress = response.PodProgressRunningAbove50U
-		}
 	case *command.StopDelivery:
-		if c.StopBolus {
-			p.state.ExtendedBolusActive = false
-		}
-		if c.StopTempBasal {
-			p.state.TempBasalEnd = time.Time{}
-		}
-		if c.StopBasal {
-			p.state.BasalActive = false
-		}
+		p.stopDelivery(c, time.Now())
+	case *command.ProgramAlerts:
+		p.programAlerts(c, time.Now())
+	case *command.ProgramBeeps:
+		p.programBeeps(c)
 	case *command.SilenceAlerts:
 		p.state.ActiveAlertSlots = p.state.ActiveAlertSlots &^ c.AlertMask
+	case *command.Deactivate:
+		p.state.PodProgress = response.PodProgressPodInactive
+		p.state.BasalActive = false
+		p.state.TempBasalEnd = time.Time{}
+		p.state.ExtendedBolusActive = false
 	default:
 		// No action
 	}
+	switch cmd.(type) {
+	case *command.ProgramInsulin, *command.StopDelivery, *command.ProgramBeeps, *command.Deactivate:
+		p.scheduleBeeps()
+	}
+	// a bolus can bring the reservoir below an alert level
+	p.fireAlerts(time.Now())
 	if cmd.DoesMutatePodState() {
 		log.Debugf("pkg pod; Updating LastProgSeqNum = %d", cmd.GetSeq())
 		p.state.LastProgSeqNum = cmd.GetSeq()
 	}
 }
 
+func (p *Pod) SetDisconnectPolicy(policy DisconnectPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	log.Infof("pkg pod; disconnect policy: %s", policy)
+	p.mtx.Lock()
+	p.disconnectPolicy = policy
+	p.mtx.Unlock()
+	return nil
+}
+
+// InjectTransportFaults makes the BLE transport misbehave, see bluetooth.FaultInjection
+func (p *Pod) InjectTransportFaults(f bluetooth.FaultInjection, perMessage bool) error {
+	return p.ble.InjectFaults(f, perMessage)
+}
+
+func (p *Pod) ClearTransportFaults() {
+	log.Infof("pkg pod; clearing transport faults")
+	p.ble.ClearFaults()
+}
+
 func (p *Pod) SetReservoir(newVal float32) {
 	p.mtx.Lock()
 	p.state.Reservoir = uint16(newVal * 20)
@@ -484,26 +876,48 @@ func (p *Pod) SetAlerts(newVal uint8) {
 
 func (p *Pod) SetFault(newVal uint8) {
 	p.mtx.Lock()
-	p.state.FaultEvent = newVal
-	p.state.FaultTime = p.state.MinutesActive()
+	p.setFault(newVal)
 	p.state.Save()
 	p.mtx.Unlock()
 }
 
-func (p *Pod) SetActiveTime(newVal int) {
-	p.mtx.Lock()
-	p.state.ActivationTime = time.Now().Add(-time.Duration(newVal) * time.Minute)
-	p.state.Save()
-	p.mtx.Unlock()
+// setFault faults the pod the way a real pod does: all delivery stops, the
+// rest of a running bolus is not delivered, PodProgress moves to Fault and
+// the alerts of the fault are set. Code 0 only clears the fault event.
+// p.mtx must be held.
+func (p *Pod) setFault(code uint8) {
+	p.state.FaultEvent = code
+	p.state.FaultTime = p.state.MinutesActive()
+	if code == 0 {
+		p.state.BolusNotDelivered = 0
+		log.Infof("pkg pod; fault cleared")
+		return
+	}
+
+	f, ok := response.LookupFault(code)
+	if !ok {
+		f = response.Fault{Code: code, Name: response.FaultName(code), Description: "unknown fault"}
+	}
+	log.Infof("pkg pod; fault 0x%02x %s: %s", f.Code, f.Name, f.Description)
+
+	p.state.BolusNotDelivered = p.state.cancelBolus(time.Now())
+	p.state.BasalActive = false
+	p.state.TempBasalEnd = time.Time{}
+	p.state.ExtendedBolusActive = false
+
+	if code == response.FaultReservoirEmpty {
+		p.state.Reservoir = 0
+	}
+	p.state.ActiveAlertSlots |= f.Alerts
+	if p.state.PodProgress != response.PodProgressPodInactive {
+		p.state.PodProgress = response.PodProgressFault
+	}
+	p.scheduleBeeps()
 }
 
-func (p *Pod) CrashNextCommand(beforeProcessing bool) {
+func (p *Pod) SetActiveTime(newVal int) {
 	p.mtx.Lock()
-	if beforeProcessing {
-		crashBeforeProcessingCommand = true
-	} else {
-		crashAfterProcessingCommand = true
-	}
+	p.state.ActivationTime = time.Now().Add(-time.Duration(newVal) * time.Minute)
 	p.state.Save()
 	p.mtx.Unlock()
 }
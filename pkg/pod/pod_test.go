@@ -0,0 +1,303 @@
+package pod
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/avereha/pod/pkg/command"
+	"github.com/avereha/pod/pkg/response"
+)
+
+func TestPod_SetFault(t *testing.T) {
+	p := &Pod{state: &PODState{
+		PodProgress:    response.PodProgressRunningAbove50U,
+		ActivationTime: time.Now().Add(-time.Hour),
+		Reservoir:      100,
+		Delivered:      40,
+		BasalActive:    true,
+		TempBasalEnd:   time.Now().Add(time.Hour),
+		// 20 pulses left, taken from the reservoir when programmed
+		BolusEnd: time.Now().Add(41 * time.Second),
+	}}
+	p.setFault(response.FaultReservoirEmpty)
+
+	s := p.state
+	if s.PodProgress != response.PodProgressFault || s.FaultEvent != 0x18 || s.FaultTime != 60 {
+		t.Errorf("pod not faulted: %+v", s)
+	}
+	if s.BasalActive || !s.TempBasalEnd.IsZero() || !s.BolusEnd.IsZero() {
+		t.Errorf("delivery should stop: %+v", s)
+	}
+	if s.BolusNotDelivered != 20 || s.Delivered != 20 || s.Reservoir != 0 {
+		t.Errorf("bolus not delivered %d, delivered %d, reservoir %d", s.BolusNotDelivered, s.Delivered, s.Reservoir)
+	}
+	if s.ActiveAlertSlots != response.AlertSlotLowReservoir {
+		t.Errorf("alerts = %08b", s.ActiveAlertSlots)
+	}
+	rsp := p.makeDetailedStatusResponse().(*response.DetailedStatusResponse)
+	if rsp.BolusRemaining != 20 || rsp.BasalActive || rsp.PodProgress != response.PodProgressFault {
+		t.Errorf("unexpected detailed status: %+v", rsp)
+	}
+}
+
+func TestPod_BolusAfterFault(t *testing.T) {
+	p := &Pod{state: &PODState{
+		PodProgress:    response.PodProgressRunningAbove50U,
+		ActivationTime: time.Now().Add(-time.Hour),
+		Reservoir:      100,
+		BasalActive:    true,
+	}}
+	p.setFault(response.FaultOccluded)
+
+	p.handleCommand(&command.ProgramInsulin{Seq: 3, TableNum: 2, Pulses: 20})
+	p.handleCommand(&command.ProgramInsulin{Seq: 4, TableNum: 0, Schedule: []uint16{10}})
+	s := p.state
+	if s.Reservoir != 100 || !s.BolusEnd.IsZero() || s.BasalActive || s.LastProgSeqNum != 0 {
+		t.Errorf("a faulted pod should not deliver: %+v", s)
+	}
+	if _, ok := p.getResponse(&command.ProgramInsulin{}).(*response.DetailedStatusResponse); !ok {
+		t.Errorf("a faulted pod should answer with its detailed status")
+	}
+
+	p.handleCommand(&command.Deactivate{Seq: 5})
+	if s.PodProgress != response.PodProgressPodInactive {
+		t.Errorf("a faulted pod should deactivate, pod progress %d", s.PodProgress)
+	}
+}
+
+func TestPod_BolusLargerThanReservoir(t *testing.T) {
+	p := &Pod{state: &PODState{
+		PodProgress:    response.PodProgressRunningAbove50U,
+		ActivationTime: time.Now().Add(-time.Hour),
+		Reservoir:      30,
+		Delivered:      100,
+	}}
+	p.handleCommand(&command.ProgramInsulin{Seq: 3, TableNum: 2, Pulses: 50})
+	s := p.state
+	if s.Reservoir != 0 || s.Delivered != 130 {
+		t.Errorf("reservoir %d, delivered %d, want 0 and 130", s.Reservoir, s.Delivered)
+	}
+	if r := s.BolusRemaining(); r > 30 {
+		t.Errorf("bolus remaining %d, more than what was in the reservoir", r)
+	}
+}
+
+func TestFaultCode_UnmarshalJSON(t *testing.T) {
+	var r Rule
+	if err := json.Unmarshal([]byte(`{"action": "fault", "fault": "occluded"}`), &r); err != nil || r.Fault != 0x14 {
+		t.Errorf("fault by name: 0x%02x, %v", r.Fault, err)
+	}
+	if err := json.Unmarshal([]byte(`{"action": "fault", "fault": 24}`), &r); err != nil || r.Fault != 0x18 {
+		t.Errorf("fault by code: 0x%02x, %v", r.Fault, err)
+	}
+	if err := json.Unmarshal([]byte(`{"fault": "clogged"}`), &r); err == nil {
+		t.Errorf("unknown fault name should fail")
+	}
+}
+
+func TestPODState_Activation(t *testing.T) {
+	start := time.Now().Add(-10 * time.Minute)
+	s := &PODState{PodProgress: response.PodProgressReminderInitialized, Reservoir: 2000}
+	s.paired(start)
+
+	prime := &command.ProgramInsulin{TableNum: 2, Pulses: 52}
+	cannula := &command.ProgramInsulin{TableNum: 2, Pulses: 10}
+	if s.startActivationBolus(prime, start) {
+		t.Fatalf("priming before the delivery flags were configured")
+	}
+	s.DeliveryFlags = &command.DeliveryFlags{}
+	if !s.startActivationBolus(prime, start) || s.PodProgress != response.PodProgressPriming {
+		t.Fatalf("prime not recognized: %d", s.PodProgress)
+	}
+	// a retried prime is not delivered twice
+	s.startActivationBolus(prime, start)
+	if s.Reservoir != 2000-52 {
+		t.Errorf("reservoir %d after priming", s.Reservoir)
+	}
+	s.updateActivation(start.Add(30 * time.Second))
+	if s.PodProgress != response.PodProgressPriming {
+		t.Errorf("priming should take %s", 52*activationPulseInterval)
+	}
+	s.updateActivation(start.Add(time.Minute))
+	if s.PodProgress != response.PodProgressPrimingCompleted {
+		t.Errorf("priming should be completed: %d", s.PodProgress)
+	}
+
+	s.PodProgress = response.PodProgressBasalInitialized
+	if !s.startActivationBolus(cannula, start.Add(2*time.Minute)) || s.PodProgress != response.PodProgressInsertingCannula {
+		t.Fatalf("cannula insertion not recognized: %d", s.PodProgress)
+	}
+	s.updateActivation(start.Add(3 * time.Minute))
+	if s.PodProgress != response.PodProgressRunningAbove50U {
+		t.Errorf("pod should be running: %d", s.PodProgress)
+	}
+	if s.startActivationBolus(cannula, time.Now()) {
+		t.Errorf("a 0.5U bolus on a running pod is a bolus")
+	}
+
+	late := &PODState{PodProgress: response.PodProgressReminderInitialized}
+	late.paired(start)
+	late.updateActivation(start.Add(activationWindow + time.Minute))
+	if late.PodProgress != response.PodProgressActivationTimeExceeded {
+		t.Errorf("activation should time out: %d", late.PodProgress)
+	}
+}
+
+func TestPod_ActivationCnfgDelivFlag(t *testing.T) {
+	p := &Pod{state: &PODState{PodProgress: response.PodProgressReminderInitialized, Reservoir: 2000}}
+	p.handleCommand(&command.SetUniqueID{Seq: 1})
+	p.handleCommand(&command.ProgramInsulin{Seq: 2, TableNum: 2, Pulses: 52})
+	if p.state.PodProgress != response.PodProgressPairingCompleted {
+		t.Fatalf("a bolus before 0x08 should not prime: %d", p.state.PodProgress)
+	}
+
+	p.handleCommand(&command.CnfgDelivFlag{Seq: 3, Flags: command.DeliveryFlags{Tab5Sub17: 1}})
+	if p.state.PodProgress != response.PodProgressPairingCompleted {
+		t.Fatalf("0x08 should not change the pod progress: %d", p.state.PodProgress)
+	}
+	if p.state.LastProgSeqNum != 2 {
+		t.Errorf("0x08 is not a programming command, last prog seq %d", p.state.LastProgSeqNum)
+	}
+	if f := p.state.DeliveryFlags; f == nil || *f != (command.DeliveryFlags{Tab5Sub17: 1}) {
+		t.Errorf("delivery flags not kept: %v", f)
+	}
+	p.handleCommand(&command.ProgramInsulin{Seq: 4, TableNum: 2, Pulses: 52})
+	if p.state.PodProgress != response.PodProgressPriming {
+		t.Fatalf("prime not recognized after 0x08: %d", p.state.PodProgress)
+	}
+
+	p.state.BolusEnd = time.Now()
+	p.state.updateActivation(time.Now())
+	p.handleCommand(&command.ProgramInsulin{Seq: 5, TableNum: 0, Schedule: []uint16{10}})
+	p.handleCommand(&command.ProgramInsulin{Seq: 6, TableNum: 2, Pulses: 10})
+	if p.state.PodProgress != response.PodProgressInsertingCannula {
+		t.Errorf("cannula insertion not recognized after priming: %d", p.state.PodProgress)
+	}
+}
+
+func TestPod_VersionResponsePodID(t *testing.T) {
+	p := &Pod{state: &PODState{}}
+	rsp, err := p.applyCommand(&command.GetVersion{Seq: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := rsp.(*response.VersionResponse); !ok || r.PodID != nil || r.PodProgress != response.PodProgressReminderInitialized {
+		t.Errorf("unexpected version response before pairing: %+v", rsp)
+	}
+
+	id := []byte{0x17, 0x13, 0x9b, 0x1f}
+	rsp, err = p.applyCommand(&command.SetUniqueID{Seq: 2, Payload: id}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := rsp.(*response.SetUniqueID); !ok || !bytes.Equal(r.PodID, id) || r.PodProgress != response.PodProgressPairingCompleted {
+		t.Errorf("0x011b should report the assigned id: %+v", rsp)
+	}
+	rsp, err = p.applyCommand(&command.GetVersion{Seq: 3}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := rsp.(*response.VersionResponse); !ok || !bytes.Equal(r.PodID, id) {
+		t.Errorf("0x0115 should report the assigned id: %+v", rsp)
+	}
+}
+
+func TestPod_CompletionBeep(t *testing.T) {
+	events := make(chan Event, 4)
+	p := &Pod{state: &PODState{
+		BolusEnd: time.Now().Add(20 * time.Millisecond),
+		Beeps:    BeepSettings{Bolus: command.DeliveryBeeps{Completion: true}},
+	}}
+	p.SetWebMessageHook(func(msg []byte) {
+		var e Event
+		if err := json.Unmarshal(msg, &e); err == nil {
+			events <- e
+		}
+	})
+	p.scheduleBeeps()
+
+	select {
+	case e := <-events:
+		if e.Event != EventBeep || e.Message != "pod beeped bip-bip: bolus completed" {
+			t.Errorf("unexpected event: %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no completion beep")
+	}
+
+	// a stopped temp basal does not beep
+	p.mtx.Lock()
+	p.state.TempBasalEnd = time.Now().Add(20 * time.Millisecond)
+	p.state.Beeps.TempBasal.Completion = true
+	p.scheduleBeeps()
+	p.state.TempBasalEnd = time.Time{}
+	p.mtx.Unlock()
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event: %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPod_SuspendWithReminder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "suspend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	p := &Pod{state: &PODState{
+		Filename:     filepath.Join(dir, "state.toml"),
+		Reservoir:    1000,
+		BasalActive:  true,
+		TempBasalEnd: now.Add(time.Hour),
+	}}
+	p.programAlerts(&command.ProgramAlerts{Alerts: []command.AlertConfig{
+		{Slot: 5, Active: true, Trigger: 15, BeepType: command.BeepBipBip},
+		{Slot: 6, Active: true, Trigger: 30, BeepType: command.BeepBipBip},
+		{Slot: 4, Active: true, ReservoirTrigger: true, Trigger: 100}, // 10U
+	}}, now)
+	p.stopDelivery(&command.StopDelivery{StopBolus: true, StopTempBasal: true, StopBasal: true}, now)
+
+	s := p.state
+	if s.SuspendedAt != now || s.BasalActive || !s.TempBasalEnd.IsZero() || deliveryStatus(s) != "suspended" {
+		t.Errorf("pod not suspended: %+v", s)
+	}
+	rsp := p.makeGeneralStatusResponse().(*response.GeneralStatusResponse)
+	if rsp.BasalActive || rsp.TempBasalActive || rsp.BolusActive {
+		t.Errorf("delivery bits should be clear: %+v", rsp)
+	}
+
+	// the pending alerts survive a restart
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewState(s.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.state = s
+	if len(s.PendingAlerts) != 3 {
+		t.Fatalf("pending alerts: %+v", s.PendingAlerts)
+	}
+
+	p.fireAlerts(now.Add(20 * time.Minute))
+	if s.ActiveAlertSlots != response.AlertSlotSuspendInProgress {
+		t.Errorf("suspend in progress should be active: %08b", s.ActiveAlertSlots)
+	}
+	p.fireAlerts(now.Add(30 * time.Minute))
+	if s.ActiveAlertSlots != response.AlertSlotSuspendInProgress|response.AlertSlotSuspendEnded {
+		t.Errorf("suspend ended should be active: %08b", s.ActiveAlertSlots)
+	}
+	s.Reservoir = 150
+	p.fireAlerts(now.Add(30 * time.Minute))
+	if s.ActiveAlertSlots&response.AlertSlotLowReservoir == 0 || len(s.PendingAlerts) != 0 {
+		t.Errorf("low reservoir should be active: %08b, pending: %+v", s.ActiveAlertSlots, s.PendingAlerts)
+	}
+}
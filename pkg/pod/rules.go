@@ -0,0 +1,429 @@
+package pod
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	toml "github.com/pelletier/go-toml"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/avereha/pod/pkg/command"
+	"github.com/avereha/pod/pkg/response"
+)
+
+// RuleAction is what a rule does to a command it matches
+type RuleAction string
+
+const (
+	// Answer with a 0x06 error response, the command is not applied
+	RuleError RuleAction = "error"
+	// Wait before sending the response
+	RuleDelay RuleAction = "delay"
+	// Fault the pod, the command is not applied and the response is the detailed status
+	RuleFault RuleAction = "fault"
+	// Change fields of the status response
+	RuleStatus RuleAction = "status"
+	// Apply the command and drop the response, like LostResponseDropped
+	RuleDrop RuleAction = "drop"
+	// Apply the command and close the connection, like LostResponseDisconnect
+	RuleDisconnect RuleAction = "disconnect"
+)
+
+// Rule changes how the pod reacts to the commands it matches. Conditions
+// that are not set match every command. The first rule that matches fires.
+type Rule struct {
+	Name string `toml:"name" json:"name"`
+
+	// Command name like GET_STATUS, or its type like 0x0e. PROGRAM_BASAL,
+	// PROGRAM_TEMP_BASAL and PROGRAM_BOLUS match the 0x1a that comes with them.
+	Command string `toml:"command" json:"command,omitempty"`
+	// Bolus size, in units
+	BolusMin *float64 `toml:"bolus_min" json:"bolusMin,omitempty"`
+	BolusMax *float64 `toml:"bolus_max" json:"bolusMax,omitempty"`
+	// Temp basal rate, in U/h
+	TempBasalMin *float64 `toml:"temp_basal_min" json:"tempBasalMin,omitempty"`
+	TempBasalMax *float64 `toml:"temp_basal_max" json:"tempBasalMax,omitempty"`
+	// GET_STATUS request type
+	StatusType  *int  `toml:"status_type" json:"statusType,omitempty"`
+	PodProgress []int `toml:"pod_progress" json:"podProgress,omitempty"`
+	// Let this many matching commands through before firing
+	Skip int `toml:"skip" json:"skip,omitempty"`
+	// Fire this many times, 0 for every matching command
+	Times int `toml:"times" json:"times,omitempty"`
+
+	Action       RuleAction       `toml:"action" json:"action"`
+	ErrorCode    uint8            `toml:"error_code" json:"errorCode,omitempty"`
+	DelaySeconds float64          `toml:"delay_seconds" json:"delaySeconds,omitempty"`
+	Fault        FaultCode        `toml:"fault" json:"fault,omitempty"`
+	Status       map[string]int64 `toml:"status" json:"status,omitempty"`
+
+	Fired   int `toml:"-" json:"fired"`
+	matched int
+}
+
+// FaultCode is a fault event code. In JSON and scenario files it can also
+// be a name from the fault catalog, like "occluded".
+type FaultCode uint8
+
+func (c *FaultCode) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	code, err := response.ParseFault(fmt.Sprint(v))
+	if err != nil {
+		return err
+	}
+	*c = FaultCode(code)
+	return nil
+}
+
+// Scenario is a set of rules, loaded from a TOML file with one [[rule]] table each
+type Scenario struct {
+	Rules []Rule `toml:"rule"`
+}
+
+// rule keys with floats, go-toml does not turn integers into floats
+var ruleFloatKeys = []string{"bolus_min", "bolus_max", "temp_basal_min", "temp_basal_max", "delay_seconds"}
+
+var ruleCommandTables = map[string]byte{
+	"PROGRAM_BASAL":      0,
+	"PROGRAM_TEMP_BASAL": 1,
+	"PROGRAM_BOLUS":      2,
+}
+
+func (r *Rule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("rule without a name")
+	}
+	if r.Command != "" {
+		if _, _, err := parseRuleCommand(r.Command); err != nil {
+			return fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+	}
+	if r.Skip < 0 || r.Times < 0 {
+		return fmt.Errorf("rule %s: skip and times can not be negative", r.Name)
+	}
+	switch r.Action {
+	case RuleError:
+		if r.ErrorCode == 0 {
+			return fmt.Errorf("rule %s: error needs an error_code", r.Name)
+		}
+	case RuleDelay:
+		if r.DelaySeconds <= 0 {
+			return fmt.Errorf("rule %s: delay needs delay_seconds", r.Name)
+		}
+	case RuleFault:
+		if r.Fault == 0 {
+			return fmt.Errorf("rule %s: fault needs a fault code", r.Name)
+		}
+	case RuleStatus:
+		if len(r.Status) == 0 {
+			return fmt.Errorf("rule %s: status needs the fields to change", r.Name)
+		}
+		for field := range r.Status {
+			if !isStatusField(field) {
+				return fmt.Errorf("rule %s: unknown status field %s", r.Name, field)
+			}
+		}
+	case RuleDrop, RuleDisconnect:
+	default:
+		return fmt.Errorf("rule %s: unknown action %q. Use one of: %s, %s, %s, %s, %s, %s", r.Name, r.Action,
+			RuleError, RuleDelay, RuleFault, RuleStatus, RuleDrop, RuleDisconnect)
+	}
+	return nil
+}
+
+// parseRuleCommand returns the command type a rule matches, and the 0x1a
+// table for the insulin programs, or -1
+func parseRuleCommand(s string) (command.Type, int, error) {
+	name := strings.ToUpper(s)
+	if table, ok := ruleCommandTables[name]; ok {
+		return command.PROGRAM_INSULIN, int(table), nil
+	}
+	for t, n := range command.CommandName {
+		if n == name {
+			return t, -1, nil
+		}
+	}
+	t, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unknown command %q", s)
+	}
+	return command.Type(t), -1, nil
+}
+
+func (r *Rule) matches(cmd command.Command, progress response.PodProgress) bool {
+	if r.Command != "" {
+		t, table, _ := parseRuleCommand(r.Command)
+		if cmd.GetType() != t {
+			return false
+		}
+		if c, ok := cmd.(*command.ProgramInsulin); ok && table >= 0 && int(c.TableNum) != table {
+			return false
+		}
+	}
+	if r.BolusMin != nil || r.BolusMax != nil {
+		c, ok := cmd.(*command.ProgramInsulin)
+		if !ok || c.TableNum != 2 || !inRange(float64(c.Pulses)*0.05, r.BolusMin, r.BolusMax) {
+			return false
+		}
+	}
+	if r.TempBasalMin != nil || r.TempBasalMax != nil {
+		c, ok := cmd.(*command.ProgramInsulin)
+		if !ok || c.TableNum != 1 || len(c.Schedule) == 0 {
+			return false
+		}
+		// pulses per half hour * 0.05U * 2
+		if !inRange(float64(c.Schedule[0])*0.1, r.TempBasalMin, r.TempBasalMax) {
+			return false
+		}
+	}
+	if r.StatusType != nil {
+		c, ok := cmd.(*command.GetStatus)
+		if !ok || int(c.RequestType) != *r.StatusType {
+			return false
+		}
+	}
+	if len(r.PodProgress) > 0 {
+		found := false
+		for _, p := range r.PodProgress {
+			found = found || p == int(progress)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func inRange(v float64, min, max *float64) bool {
+	// some slack, multiples of 0.05U are not exact in floats
+	const epsilon = 0.001
+	return (min == nil || v > *min-epsilon) && (max == nil || v < *max+epsilon)
+}
+
+// statusTypes are the responses a status rule can change
+var statusTypes = []reflect.Type{
+	reflect.TypeOf(response.GeneralStatusResponse{}),
+	reflect.TypeOf(response.DetailedStatusResponse{}),
+}
+
+// statusField matches the name of a status response field. Rules can give it
+// like the field, BolusActive, or like their other keys: bolusActive in JSON
+// and bolus_active in scenario files.
+func statusField(name string) func(string) bool {
+	name = strings.ToLower(strings.Replace(name, "_", "", -1))
+	return func(field string) bool {
+		return strings.ToLower(field) == name
+	}
+}
+
+func isStatusField(name string) bool {
+	if statusField(name)("Seq") {
+		return false
+	}
+	for _, t := range statusTypes {
+		if f, ok := t.FieldByNameFunc(statusField(name)); ok && settable(f.Type.Kind()) {
+			return true
+		}
+	}
+	return false
+}
+
+func settable(k reflect.Kind) bool {
+	switch k {
+	case reflect.Bool, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint:
+		return true
+	}
+	return false
+}
+
+// overrideStatus sets fields of a status response. Responses that are not a
+// status, and fields they do not have, are left alone.
+func overrideStatus(rsp response.Response, fields map[string]int64) {
+	v := reflect.ValueOf(rsp)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+	v = v.Elem()
+	for name, value := range fields {
+		f := v.FieldByNameFunc(statusField(name))
+		if !f.IsValid() || !f.CanSet() {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.Bool:
+			f.SetBool(value != 0)
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
+			f.SetInt(value)
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint:
+			f.SetUint(uint64(value))
+		}
+	}
+}
+
+// matchRule returns the rule that fires for cmd, if any. p.mtx must be held.
+func (p *Pod) matchRule(cmd command.Command) *Rule {
+	for _, r := range p.rules {
+		if !r.matches(cmd, p.state.PodProgress) {
+			continue
+		}
+		r.matched++
+		if r.matched <= r.Skip || (r.Times > 0 && r.Fired >= r.Times) {
+			continue
+		}
+		r.Fired++
+		ret := *r
+		return &ret
+	}
+	return nil
+}
+
+// AddRule adds r after the existing rules, or replaces the rule with its name
+func (p *Pod) AddRule(r Rule) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	r.Fired = 0
+	r.matched = 0
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for i, existing := range p.rules {
+		if existing.Name == r.Name {
+			p.rules[i] = &r
+			log.Infof("pkg pod; replaced rule %s: %+v", r.Name, r)
+			return nil
+		}
+	}
+	p.rules = append(p.rules, &r)
+	log.Infof("pkg pod; added rule %s: %+v", r.Name, r)
+	return nil
+}
+
+func (p *Pod) RemoveRule(name string) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for i, r := range p.rules {
+		if r.Name == name {
+			p.rules = append(p.rules[:i], p.rules[i+1:]...)
+			log.Infof("pkg pod; removed rule %s", name)
+			return nil
+		}
+	}
+	return fmt.Errorf("no rule named %s", name)
+}
+
+func (p *Pod) ClearRules() {
+	p.mtx.Lock()
+	p.rules = nil
+	p.mtx.Unlock()
+	log.Infof("pkg pod; cleared the rules")
+}
+
+// Rules returns a copy of the rules, with how many times each one fired
+func (p *Pod) Rules() []Rule {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	ret := make([]Rule, 0, len(p.rules))
+	for _, r := range p.rules {
+		ret = append(ret, *r)
+	}
+	return ret
+}
+
+// SendRuleList sends the rules to the API clients
+func (p *Pod) SendRuleList() {
+	rules := p.Rules()
+	p.emitEventData(EventRules, rules, "%d rules", len(rules))
+}
+
+// LoadScenario replaces the rules with the ones in a scenario file
+func (p *Pod) LoadScenario(filename string) error {
+	s, err := ReadScenario(filename)
+	if err != nil {
+		return err
+	}
+	p.ClearRules()
+	for _, r := range s.Rules {
+		if err := p.AddRule(r); err != nil {
+			return err
+		}
+	}
+	p.emitEvent(EventRules, "loaded %d rules from %s", len(s.Rules), filename)
+	return nil
+}
+
+// ReadScenario reads and validates a scenario file
+func ReadScenario(filename string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse scenario %s: %w", filename, err)
+	}
+	if rules, ok := tree.Get("rule").([]*toml.Tree); ok {
+		for _, rule := range rules {
+			for _, key := range ruleFloatKeys {
+				if v, ok := rule.Get(key).(int64); ok {
+					rule.Set(key, float64(v))
+				}
+			}
+			if name, ok := rule.Get("fault").(string); ok {
+				code, err := response.ParseFault(name)
+				if err != nil {
+					return nil, fmt.Errorf("scenario %s: %w", filename, err)
+				}
+				rule.Set("fault", int64(code))
+			}
+		}
+	}
+	var s Scenario
+	if err := tree.Unmarshal(&s); err != nil {
+		return nil, fmt.Errorf("could not parse scenario %s: %w", filename, err)
+	}
+	names := make(map[string]bool)
+	for i := range s.Rules {
+		if err := s.Rules[i].Validate(); err != nil {
+			return nil, fmt.Errorf("scenario %s: %w", filename, err)
+		}
+		if names[s.Rules[i].Name] {
+			return nil, fmt.Errorf("scenario %s: two rules named %s", filename, s.Rules[i].Name)
+		}
+		names[s.Rules[i].Name] = true
+	}
+	return &s, nil
+}
+
+// reaction is what happens to the response of one command, besides being sent
+type reaction struct {
+	lost        LostResponseMode
+	delay       time.Duration
+	rule        *Rule // the rule that fired, if any
+	deactivated bool  // the message deactivated the pod
+	// the type of the response, like 0x1d, for pod_responses_total
+	responseType string
+}
+
+// ruleReaction is the part of a rule's action that happens in the command
+// loop, once the response is ready
+func ruleReaction(r *Rule) reaction {
+	ret := reaction{rule: r}
+	switch r.Action {
+	case RuleDelay:
+		ret.delay = time.Duration(r.DelaySeconds * float64(time.Second))
+	case RuleDrop:
+		ret.lost = LostResponseDropped
+	case RuleDisconnect:
+		ret.lost = LostResponseDisconnect
+	}
+	return ret
+}
@@ -0,0 +1,122 @@
+package pod
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/avereha/pod/pkg/command"
+	"github.com/avereha/pod/pkg/response"
+)
+
+const testScenario = `
+[[rule]]
+  name = "big bolus occludes"
+  command = "PROGRAM_BOLUS"
+  bolus_min = 5
+  action = "fault"
+  fault = 0x14
+
+[[rule]]
+  name = "second status is slow"
+  command = "GET_STATUS"
+  status_type = 0
+  skip = 1
+  times = 1
+  action = "delay"
+  delay_seconds = 2.5
+
+[[rule]]
+  name = "low reservoir"
+  command = "0x0e"
+  action = "status"
+  [rule.status]
+    Reservoir = 100
+    bolus_active = 1
+`
+
+func TestPod_Rules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "scenario.toml")
+	if err := ioutil.WriteFile(filename, []byte(testScenario), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Pod{state: &PODState{PodProgress: response.PodProgressRunningAbove50U}}
+	if err := p.LoadScenario(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	smallBolus := &command.ProgramInsulin{TableNum: 2, Pulses: 20}
+	bigBolus := &command.ProgramInsulin{TableNum: 2, Pulses: 100}
+	basal := &command.ProgramInsulin{TableNum: 0, Pulses: 100}
+	if r := p.matchRule(smallBolus); r != nil {
+		t.Errorf("1U bolus should not match, got %s", r.Name)
+	}
+	if r := p.matchRule(basal); r != nil {
+		t.Errorf("basal should not match, got %s", r.Name)
+	}
+	if r := p.matchRule(bigBolus); r == nil || r.Action != RuleFault || r.Fault != 0x14 {
+		t.Errorf("5U bolus should fault, got %+v", r)
+	}
+
+	status := &command.GetStatus{RequestType: 0}
+	var got []string
+	for i := 0; i < 3; i++ {
+		got = append(got, p.matchRule(status).Name)
+	}
+	want := []string{"low reservoir", "second status is slow", "low reservoir"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("status rules fired %v, want %v", got, want)
+		}
+	}
+
+	rsp := &response.GeneralStatusResponse{Reservoir: 3000}
+	overrideStatus(rsp, p.Rules()[2].Status)
+	if rsp.Reservoir != 100 || !rsp.BolusActive {
+		t.Errorf("status not overridden: %+v", rsp)
+	}
+
+	if err := p.RemoveRule("low reservoir"); err != nil {
+		t.Fatal(err)
+	}
+	if r := p.matchRule(status); r != nil {
+		t.Errorf("no rule should fire anymore, got %s", r.Name)
+	}
+}
+
+func TestRule_Validate(t *testing.T) {
+	for _, r := range []Rule{
+		{Action: RuleDrop},
+		{Name: "a", Action: "explode"},
+		{Name: "a", Command: "FLY", Action: RuleDrop},
+		{Name: "a", Action: RuleError},
+		{Name: "a", Action: RuleStatus, Status: map[string]int64{"Seq": 1}},
+		{Name: "a", Action: RuleDrop, Skip: -1},
+	} {
+		if err := r.Validate(); err == nil {
+			t.Errorf("%+v should not be valid", r)
+		}
+	}
+
+	var r Rule
+	data := `{"name": "faulted", "action": "status", "status": {"isFaulted": 1, "fault_event": 20}}`
+	if err := json.Unmarshal([]byte(data), &r); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	rsp := &response.DetailedStatusResponse{}
+	overrideStatus(rsp, r.Status)
+	if !rsp.IsFaulted || rsp.FaultEvent != 20 {
+		t.Errorf("status not overridden: %+v", rsp)
+	}
+}
@@ -0,0 +1,295 @@
+package pod
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	toml "github.com/pelletier/go-toml"
+	log "github.com/sirupsen/logrus"
+)
+
+// Snapshot is a named copy of the pod state, saved next to the state file
+type Snapshot struct {
+	Name    string         `toml:"name"`
+	Taken   time.Time      `toml:"taken"`
+	State   PODState       `toml:"state"`
+	History []HistoryEntry `toml:"history"`
+}
+
+// FieldDiff is one state field that differs between two snapshots
+type FieldDiff struct {
+	Field string
+	A     string
+	B     string
+}
+
+// CurrentSnapshot is the name to use in DiffSnapshots for the live state
+const CurrentSnapshot = "current"
+
+var snapshotName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// These fields belong to the pairing with the app and the current session.
+// They are not restored, or the app could not talk to the pod anymore.
+var keepOnRestore = []string{"Id", "MsgSeq", "CmdSeq", "NonceSeq", "LastProgSeqNum"}
+
+// The pairing and session keys are kept on restore too. Snapshots do not
+// store them, and diffs only show them with exposeKeys, like the state view.
+var keyFields = []string{"LTK", "EapAkaSeq", "NoncePrefix", "CK"}
+
+// Bookkeeping of the state file, not part of the pod state
+var notInDiff = []string{"SchemaVersion", "Generation", "Filename"}
+
+// timeFields are shifted on restore, so the restored pod has the same age
+// and the same time left on its deliveries as when the snapshot was taken
+func (p *PODState) timeFields() []*time.Time {
+	ret := []*time.Time{
+		&p.ActivationTime,
+		&p.PairedAt,
+		&p.BolusEnd,
+		&p.BolusCanceledAt,
+		&p.TempBasalEnd,
+		&p.BasalScheduleStart,
+		&p.SuspendedAt,
+	}
+	for i := range p.PendingAlerts {
+		ret = append(ret, &p.PendingAlerts[i].At)
+	}
+	return ret
+}
+
+func (p *Pod) snapshotDir() string {
+	return p.state.Filename + ".snapshots"
+}
+
+func (p *Pod) snapshotFilename(name string) (string, error) {
+	if !snapshotName.MatchString(name) || name == CurrentSnapshot {
+		return "", fmt.Errorf("invalid snapshot name %q. Use letters, digits, '.', '-' and '_'", name)
+	}
+	return filepath.Join(p.snapshotDir(), name+".toml"), nil
+}
+
+// SaveSnapshot saves the current state as name, replacing any snapshot with
+// that name. withHistory also saves the command history.
+func (p *Pod) SaveSnapshot(name string, withHistory bool) error {
+	filename, err := p.snapshotFilename(name)
+	if err != nil {
+		return err
+	}
+	p.mtx.Lock()
+	s := Snapshot{
+		Name:  name,
+		Taken: time.Now(),
+		State: *p.state,
+	}
+	s.State.SchemaVersion = stateSchemaVersion
+	state := reflect.ValueOf(&s.State).Elem()
+	for _, name := range keyFields {
+		field := state.FieldByName(name)
+		field.Set(reflect.Zero(field.Type()))
+	}
+	if withHistory {
+		s.History = append([]HistoryEntry(nil), p.history...)
+	}
+	p.mtx.Unlock()
+
+	data, err := toml.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(p.snapshotDir(), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filename, data, 0644); err != nil {
+		return err
+	}
+	log.Infof("pkg pod; saved snapshot %s, history: %t", name, withHistory)
+	return nil
+}
+
+func (p *Pod) loadSnapshot(name string) (*Snapshot, error) {
+	filename, err := p.snapshotFilename(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read snapshot %s: %w", name, err)
+	}
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse snapshot %s: %w", name, err)
+	}
+	if state, ok := tree.Get("state").(*toml.Tree); ok {
+		if err := migrateState(state); err != nil {
+			return nil, err
+		}
+	}
+	var s Snapshot
+	if err := tree.Unmarshal(&s); err != nil {
+		return nil, fmt.Errorf("could not parse snapshot %s: %w", name, err)
+	}
+	return &s, nil
+}
+
+// RestoreSnapshot replaces the pod state with a snapshot. Times are moved
+// forward by the time since the snapshot was taken, and the pairing and
+// session keys are kept. The pending alerts and the delivery beeps of the
+// snapshot are armed again.
+func (p *Pod) RestoreSnapshot(name string) error {
+	s, err := p.loadSnapshot(name)
+	if err != nil {
+		return err
+	}
+	shift := time.Since(s.Taken)
+	restored := s.State
+	for _, t := range restored.timeFields() {
+		if !t.IsZero() {
+			*t = t.Add(shift)
+		}
+	}
+
+	p.mtx.Lock()
+	current := reflect.ValueOf(p.state).Elem()
+	r := reflect.ValueOf(&restored).Elem()
+	var keep []string
+	keep = append(keep, keepOnRestore...)
+	keep = append(keep, keyFields...)
+	for _, name := range append(keep, notInDiff...) {
+		r.FieldByName(name).Set(current.FieldByName(name))
+	}
+	restored.journaled = p.state.journaled
+	restored.journalEntries = p.state.journalEntries
+	*p.state = restored
+	if s.History != nil {
+		p.history = s.History
+	}
+	p.scheduleBeeps()
+	p.scheduleAlerts()
+	err = p.state.Save()
+	p.mtx.Unlock()
+	if err != nil {
+		return fmt.Errorf("could not save the restored state: %w", err)
+	}
+
+	log.Infof("pkg pod; restored snapshot %s, taken %s ago", name, shift.Round(time.Second))
+	p.notifyStateChange()
+	return nil
+}
+
+// ListSnapshots returns the names of the saved snapshots
+func (p *Pod) ListSnapshots() ([]string, error) {
+	files, err := ioutil.ReadDir(p.snapshotDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".toml") {
+			ret = append(ret, strings.TrimSuffix(f.Name(), ".toml"))
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// DiffSnapshots lists the state fields that differ between snapshots a and b.
+// CurrentSnapshot stands for the live state. Times are shown relative to
+// when each snapshot was taken. The keys are only compared with exposeKeys.
+func (p *Pod) DiffSnapshots(a, b string) ([]FieldDiff, error) {
+	sa, err := p.snapshotOrCurrent(a)
+	if err != nil {
+		return nil, err
+	}
+	sb, err := p.snapshotOrCurrent(b)
+	if err != nil {
+		return nil, err
+	}
+	p.mtx.Lock()
+	withKeys := p.exposeKeys
+	p.mtx.Unlock()
+	return diffStates(sa, sb, withKeys), nil
+}
+
+func (p *Pod) snapshotOrCurrent(name string) (*Snapshot, error) {
+	if name != CurrentSnapshot {
+		return p.loadSnapshot(name)
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return &Snapshot{
+		Name:  name,
+		Taken: time.Now(),
+		State: *p.state,
+	}, nil
+}
+
+// SendSnapshotList sends the snapshot names to the API clients
+func (p *Pod) SendSnapshotList() error {
+	names, err := p.ListSnapshots()
+	if err != nil {
+		return err
+	}
+	p.emitEventData(EventSnapshots, names, "%d snapshots", len(names))
+	return nil
+}
+
+// SendSnapshotDiff sends the differences between a and b to the API clients
+func (p *Pod) SendSnapshotDiff(a, b string) error {
+	diff, err := p.DiffSnapshots(a, b)
+	if err != nil {
+		return err
+	}
+	p.emitEventData(EventSnapshotDiff, diff, "%d fields differ between %s and %s", len(diff), a, b)
+	return nil
+}
+
+func diffStates(a, b *Snapshot, withKeys bool) []FieldDiff {
+	var ret []FieldDiff
+	va := reflect.ValueOf(a.State)
+	vb := reflect.ValueOf(b.State)
+	t := va.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || contains(notInDiff, f.Name) || (!withKeys && contains(keyFields, f.Name)) {
+			continue
+		}
+		fa := formatField(va.Field(i).Interface(), a.Taken)
+		fb := formatField(vb.Field(i).Interface(), b.Taken)
+		if fa != fb {
+			ret = append(ret, FieldDiff{Field: f.Name, A: fa, B: fb})
+		}
+	}
+	return ret
+}
+
+func formatField(v interface{}, taken time.Time) string {
+	switch v := v.(type) {
+	case time.Time:
+		if v.IsZero() {
+			return "never"
+		}
+		return fmt.Sprintf("%s from snapshot", v.Sub(taken).Round(time.Second))
+	case []byte:
+		return fmt.Sprintf("%x", v)
+	}
+	return fmt.Sprint(v)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package pod
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/avereha/pod/pkg/command"
+)
+
+func TestPod_Snapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "podsnapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	activation := time.Now().Add(-71 * time.Hour)
+	p := &Pod{
+		state: &PODState{
+			Filename:       filepath.Join(dir, "state.toml"),
+			LTK:            []byte{1, 2, 3},
+			NonceSeq:       5,
+			Reservoir:      160,
+			ActivationTime: activation,
+		},
+	}
+	if err := p.SaveSnapshot("71h-8U", false); err != nil {
+		t.Fatal(err)
+	}
+	s, err := p.loadSnapshot("71h-8U")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.State.LTK) != 0 || s.State.NonceSeq != 5 {
+		t.Errorf("snapshots should store the state without the keys: %+v", s.State)
+	}
+	if err := p.SaveSnapshot("../escape", false); err == nil {
+		t.Errorf("snapshot names with a path should be refused")
+	}
+
+	p.state.Reservoir = 3000
+	p.state.ActivationTime = time.Now()
+	p.state.NonceSeq = 9
+	p.state.LTK = []byte{4, 5, 6}
+	p.state.EapAkaSeq = 2
+
+	diff, err := p.DiffSnapshots("71h-8U", CurrentSnapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := make(map[string]bool)
+	for _, d := range diff {
+		changed[d.Field] = true
+	}
+	for _, f := range []string{"Reservoir", "ActivationTime", "NonceSeq"} {
+		if !changed[f] {
+			t.Errorf("%s should be in the diff: %+v", f, diff)
+		}
+	}
+	for _, f := range keyFields {
+		if changed[f] {
+			t.Errorf("%s should not be in the diff without exposeKeys: %+v", f, diff)
+		}
+	}
+	p.SetExposeKeys(true)
+	diff, err = p.DiffSnapshots("71h-8U", CurrentSnapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff) == 0 || !strings.Contains(fmt.Sprint(diff), "LTK") {
+		t.Errorf("LTK should be in the diff with exposeKeys: %+v", diff)
+	}
+	p.SetExposeKeys(false)
+
+	if err := p.RestoreSnapshot("71h-8U"); err != nil {
+		t.Fatal(err)
+	}
+	if p.state.Reservoir != 160 {
+		t.Errorf("reservoir %d, want 160", p.state.Reservoir)
+	}
+	if age := p.state.MinutesActive(); age < 71*60 || age > 71*60+1 {
+		t.Errorf("restored pod is %d minutes old, want 71h", age)
+	}
+	if p.state.NonceSeq != 9 || p.state.LTK[0] != 4 {
+		t.Errorf("session and pairing keys should be kept on restore")
+	}
+}
+
+func TestPod_RestoreSnapshotArmsAlerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "podsnapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// suspended with the suspend ended alert coming up
+	p := &Pod{state: &PODState{
+		Filename:      filepath.Join(dir, "state.toml"),
+		Reservoir:     1000,
+		SuspendedAt:   time.Now(),
+		PendingAlerts: []PendingAlert{{Slot: 6, At: time.Now().Add(50 * time.Millisecond), BeepType: command.BeepBipBip}},
+	}}
+	if err := p.SaveSnapshot("suspended", false); err != nil {
+		t.Fatal(err)
+	}
+	p.state.PendingAlerts = nil
+	p.state.SuspendedAt = time.Time{}
+
+	events := make(chan Event, 8)
+	p.SetWebMessageHook(func(msg []byte) {
+		var e Event
+		if err := json.Unmarshal(msg, &e); err == nil && e.Event == EventAlert {
+			events <- e
+		}
+	})
+	if err := p.RestoreSnapshot("suspended"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Fatalf("the restored alert did not fire")
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.state.ActiveAlertSlots&(1<<6) == 0 || len(p.state.PendingAlerts) != 0 {
+		t.Errorf("alert slot 6 should be active: alerts %08b, pending %+v", p.state.ActiveAlertSlots, p.state.PendingAlerts)
+	}
+}
@@ -7,9 +7,13 @@ import (
 	toml "github.com/pelletier/go-toml"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/avereha/pod/pkg/command"
 	"github.com/avereha/pod/pkg/response"
 )
 
+// Nominal pod lifetime, after which the pod reports itself expired
+const podLifetime = 72 * time.Hour
+
 type PODState struct {
 	LTK       []byte `toml:"ltk"`
 	EapAkaSeq uint64 `toml:"eap_aka_seq"`
@@ -25,14 +29,17 @@ type PODState struct {
 	NoncePrefix []byte `toml:"nonce_prefix"`
 	CK          []byte `toml:"ck"`
 
-	PodProgress    response.PodProgress
-	ActivationTime time.Time `toml:"activation_time"`
+	PodProgress    response.PodProgress `toml:"pod_progress"`
+	ActivationTime time.Time            `toml:"activation_time"`
+	PairedAt       time.Time            `toml:"paired_at"` // start of the activation window
 
 	Reservoir        uint16 `toml:"reservoir"`
 	ActiveAlertSlots uint8  `toml:"alerts"`
 	FaultEvent       uint8  `toml:"fault"`
 	FaultTime        uint16 `toml:"fault_time"`
 	Delivered        uint16 `toml:"delivered"`
+	// Bolus pulses that were not delivered, the bolus was stopped or faulted
+	BolusNotDelivered uint16 `toml:"bolus_not_delivered"`
 
 	// At some point these could be replaced with details
 	// of each kind of delivery (volume, start time, schedule, etc)
@@ -41,8 +48,36 @@ type PODState struct {
 	TempBasalEnd        time.Time `toml:"temp_basal_end"`
 	ExtendedBolusActive bool      `toml:"extended_bolus_active"`
 	BasalActive         bool      `toml:"basal_active"`
+	SuspendedAt         time.Time `toml:"suspended_at"` // zero when not suspended
+
+	// Pulses per half hour, as programmed by the last 0x1a commands
+	BasalSchedule      []uint16  `toml:"basal_schedule"`
+	BasalScheduleStart time.Time `toml:"basal_schedule_start"` // start of segment 0 in pod time
+	TempBasalPulses    uint16    `toml:"temp_basal_pulses"`
+
+	Beeps BeepSettings `toml:"beeps"`
+	// Set by 0x08, nil until the app sent one
+	DeliveryFlags *command.DeliveryFlags `toml:"delivery_flags"`
+	// Alerts programmed with 0x19 that did not fire yet
+	PendingAlerts []PendingAlert `toml:"pending_alerts"`
+
+	SchemaVersion int   `toml:"schema_version"`
+	Generation    int64 `toml:"generation"` // ties the journal to this version of the file
+
+	Filename string `toml:"-"`
 
-	Filename string
+	journaled      stateCounters
+	journalEntries int
+}
+
+// NewFreshState is the state of a new pod, not activated yet and filled with
+// initialReservoir units. It is saved to filename.
+func NewFreshState(filename string, initialReservoir float32) *PODState {
+	return &PODState{
+		Reservoir:      uint16(initialReservoir / 0.05),
+		ActivationTime: time.Now(),
+		Filename:       filename,
+	}
 }
 
 func NewState(filename string) (*PODState, error) {
@@ -52,20 +87,40 @@ func NewState(filename string) (*PODState, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = toml.Unmarshal(data, &ret)
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateState(tree); err != nil {
+		return nil, err
+	}
+	err = tree.Unmarshal(&ret)
 	if err != nil {
 		return nil, err
 	}
+	if err := ret.replayJournal(); err != nil {
+		return nil, err
+	}
 	return &ret, nil
 }
 
+// Save writes the whole state. The file is replaced atomically, so a crash
+// leaves either the old or the new state, never a mix. This also compacts
+// the journal.
 func (p *PODState) Save() error {
 	log.Debugf("Saving state to file: %s", p.Filename)
+	p.SchemaVersion = stateSchemaVersion
+	p.Generation = time.Now().UnixNano()
 	data, err := toml.Marshal(p)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(p.Filename, data, 0777)
+	if err := writeFileAtomic(p.Filename, data, 0644); err != nil {
+		return err
+	}
+	p.journaled = p.counters()
+	p.journalEntries = 0
+	return p.truncateJournal()
 }
 
 func (p *PODState) MinutesActive() uint16 {
@@ -80,3 +135,60 @@ func (p *PODState) BolusRemaining() uint16 {
 		return 0
 	}
 }
+
+// bolusNotDelivered returns the pulses left of the running bolus, or the
+// ones a stopped or faulted bolus did not deliver, as the status reports it
+func (p *PODState) bolusNotDelivered() uint16 {
+	if p.BolusEnd.After(time.Now()) {
+		return p.BolusRemaining()
+	}
+	return p.BolusNotDelivered
+}
+
+// takeFromReservoir delivers pulses and returns how many it could: a bolus
+// larger than what is left in the reservoir only delivers the rest
+func (p *PODState) takeFromReservoir(pulses uint16) uint16 {
+	if pulses > p.Reservoir {
+		log.Warnf("pkg pod; %d pulses programmed, only %d left in the reservoir", pulses, p.Reservoir)
+		pulses = p.Reservoir
+	}
+	p.Reservoir -= pulses
+	p.Delivered += pulses
+	return pulses
+}
+
+// cancelBolus stops a running bolus and returns the pulses it did not
+// deliver. The whole bolus was taken from the reservoir when it was programmed.
+func (p *PODState) cancelBolus(now time.Time) uint16 {
+	if !p.BolusEnd.After(now) {
+		return 0
+	}
+	notDelivered := p.BolusRemaining()
+	p.Delivered -= notDelivered
+	p.Reservoir += notDelivered
+	p.BolusEnd = time.Time{}
+	p.BolusCanceledAt = now
+	return notDelivered
+}
+
+// BasalRate returns the basal rate currently delivered, in U/h
+func (p *PODState) BasalRate() float32 {
+	now := time.Now()
+	if p.TempBasalEnd.After(now) {
+		return float32(p.TempBasalPulses) / 10
+	}
+	if !p.BasalActive || len(p.BasalSchedule) == 0 {
+		return 0
+	}
+	n := len(p.BasalSchedule)
+	segment := int(now.Sub(p.BasalScheduleStart)/(30*time.Minute)) % n
+	if segment < 0 {
+		segment += n
+	}
+	// pulses per half hour * 0.05U * 2
+	return float32(p.BasalSchedule[segment]) / 10
+}
+
+func (p *PODState) TimeToExpiration() time.Duration {
+	return time.Until(p.ActivationTime.Add(podLifetime)).Round(time.Minute)
+}
@@ -0,0 +1,151 @@
+package pod
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/avereha/pod/pkg/command"
+	"github.com/avereha/pod/pkg/response"
+)
+
+func TestPODState_SaveJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "podstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "state.toml")
+
+	state := &PODState{
+		Filename:    filename,
+		Reservoir:   3000,
+		PodProgress: response.PodProgressRunningAbove50U,
+		NonceSeq:    10,
+
+		DeliveryFlags: &command.DeliveryFlags{Tab5Sub17: 1},
+	}
+	if err := state.Save(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		state.NonceSeq++
+		state.MsgSeq++
+		if err := state.SaveCounters(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a crash in the middle of a journal entry
+	f, err := os.OpenFile(filename+".journal", os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("generation=1 nonce_")
+	f.Close()
+
+	back, err := NewState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.NonceSeq != 13 || back.MsgSeq != 3 {
+		t.Errorf("nonce seq %d, msg seq %d after replay, want 13 and 3", back.NonceSeq, back.MsgSeq)
+	}
+	if back.Reservoir != 3000 || back.PodProgress != response.PodProgressRunningAbove50U {
+		t.Errorf("state not restored: %+v", back)
+	}
+	if back.DeliveryFlags == nil || *back.DeliveryFlags != *state.DeliveryFlags {
+		t.Errorf("delivery flags not restored: %v", back.DeliveryFlags)
+	}
+
+	// Save compacts the journal
+	if err := back.Save(); err != nil {
+		t.Fatal(err)
+	}
+	journal, err := ioutil.ReadFile(filename + ".journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journal) != 0 {
+		t.Errorf("journal not compacted: %s", journal)
+	}
+}
+
+func TestNewState_Migration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "podstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "state.toml")
+
+	// written before the schema version was added
+	old := "PodProgress = 8\nFilename = \"state.toml\"\nnonce_seq = 42\nreservoir = 1000\n"
+	if err := ioutil.WriteFile(filename, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state, err := NewState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.PodProgress != response.PodProgressRunningAbove50U || state.NonceSeq != 42 || state.Reservoir != 1000 {
+		t.Errorf("state not migrated: %+v", state)
+	}
+	if state.Filename != filename {
+		t.Errorf("file name %s, want %s", state.Filename, filename)
+	}
+}
+
+func TestPODState_SaveMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "podstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "state.toml")
+
+	state := &PODState{Filename: filename, Reservoir: 3000}
+	if err := state.Save(); err != nil {
+		t.Fatal(err)
+	}
+	generation := state.Generation
+
+	// a status request only moves the counters
+	before := state.contents()
+	state.NonceSeq++
+	state.MsgSeq++
+	state.CmdSeq++
+	if err := state.saveMessage(before, false); err != nil {
+		t.Fatal(err)
+	}
+	if state.Generation != generation || state.journalEntries != 1 {
+		t.Errorf("the state file was rewritten for the counters, %d journal entries", state.journalEntries)
+	}
+
+	before = state.contents()
+	state.NonceSeq++
+	state.Reservoir -= 10
+	if err := state.saveMessage(before, false); err != nil {
+		t.Fatal(err)
+	}
+	if state.Generation == generation || state.journalEntries != 0 {
+		t.Errorf("the state file was not rewritten for a state change")
+	}
+	generation = state.Generation
+
+	before = state.contents()
+	if err := state.saveMessage(before, true); err != nil {
+		t.Fatal(err)
+	}
+	if state.Generation == generation {
+		t.Errorf("the state file was not rewritten for a mutating command")
+	}
+
+	back, err := NewState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.NonceSeq != 2 || back.Reservoir != 2990 {
+		t.Errorf("nonce seq %d, reservoir %d, want 2 and 2990", back.NonceSeq, back.Reservoir)
+	}
+}
@@ -0,0 +1,131 @@
+package pod
+
+import (
+	"strings"
+	"time"
+
+	"github.com/avereha/pod/pkg/command"
+	"github.com/avereha/pod/pkg/response"
+)
+
+// PodStateView is what API clients get to see of the pod state.
+// It has the derived values the frontend needs, and no key material.
+type PodStateView struct {
+	Name string // the bluetooth adapter, when several pods run in one process
+	Id   []byte
+
+	MsgSeq         uint8
+	CmdSeq         uint8
+	NonceSeq       uint64
+	LastProgSeqNum uint8
+
+	PodProgress    response.PodProgress
+	ActivationTime time.Time
+
+	Reservoir        uint16
+	ActiveAlertSlots uint8
+	FaultEvent       uint8
+	FaultName        string // empty when not faulted
+	FaultTime        uint16
+	Delivered        uint16
+
+	BolusEnd            time.Time
+	BolusCanceledAt     time.Time
+	TempBasalEnd        time.Time
+	ExtendedBolusActive bool
+	BasalActive         bool
+	SuspendedAt         time.Time
+	Beeps               BeepSettings
+	DeliveryFlags       *command.DeliveryFlags `json:",omitempty"`
+	PendingAlerts       []PendingAlert
+
+	UnitsRemaining      float32
+	UnitsDelivered      float32
+	BasalRate           float32 // U/h
+	MinutesToExpiration int     // negative once the pod is expired
+	DeliveryStatus      string
+
+	LastSessionEnd   time.Time
+	LastSessionError string
+	DisconnectPolicy string
+
+	Advertising           string // unpaired, paired, inactive or paused
+	AdvertisingIntervalMs float64
+
+	OutOfRangeUntil     time.Time
+	FlakyConnectionRate float64
+
+	// Only filled in when key exposure was explicitly enabled for debugging
+	Keys *PodKeysView `json:",omitempty"`
+}
+
+type PodKeysView struct {
+	LTK         []byte
+	EapAkaSeq   uint64
+	CK          []byte
+	NoncePrefix []byte
+}
+
+func newPodStateView(state *PODState, exposeKeys bool) *PodStateView {
+	ret := &PodStateView{
+		Id:                  state.Id,
+		MsgSeq:              state.MsgSeq,
+		CmdSeq:              state.CmdSeq,
+		NonceSeq:            state.NonceSeq,
+		LastProgSeqNum:      state.LastProgSeqNum,
+		PodProgress:         state.PodProgress,
+		ActivationTime:      state.ActivationTime,
+		Reservoir:           state.Reservoir,
+		ActiveAlertSlots:    state.ActiveAlertSlots,
+		FaultEvent:          state.FaultEvent,
+		FaultTime:           state.FaultTime,
+		Delivered:           state.Delivered,
+		BolusEnd:            state.BolusEnd,
+		BolusCanceledAt:     state.BolusCanceledAt,
+		TempBasalEnd:        state.TempBasalEnd,
+		ExtendedBolusActive: state.ExtendedBolusActive,
+		BasalActive:         state.BasalActive,
+		SuspendedAt:         state.SuspendedAt,
+		Beeps:               state.Beeps,
+		DeliveryFlags:       state.DeliveryFlags,
+		PendingAlerts:       state.PendingAlerts,
+		UnitsRemaining:      float32(state.Reservoir) * 0.05,
+		UnitsDelivered:      float32(state.Delivered) * 0.05,
+		BasalRate:           state.BasalRate(),
+		MinutesToExpiration: int(state.TimeToExpiration().Minutes()),
+		DeliveryStatus:      deliveryStatus(state),
+	}
+	if state.FaultEvent != 0 {
+		ret.FaultName = response.FaultName(state.FaultEvent)
+	}
+	if exposeKeys {
+		ret.Keys = &PodKeysView{
+			LTK:         state.LTK,
+			EapAkaSeq:   state.EapAkaSeq,
+			CK:          state.CK,
+			NoncePrefix: state.NoncePrefix,
+		}
+	}
+	return ret
+}
+
+func deliveryStatus(state *PODState) string {
+	var now = time.Now()
+	var running []string
+
+	if state.TempBasalEnd.After(now) {
+		running = append(running, "temp basal")
+	} else if state.BasalActive {
+		running = append(running, "basal")
+	}
+	if state.BolusEnd.After(now) {
+		running = append(running, "bolus")
+	}
+	if state.ExtendedBolusActive {
+		running = append(running, "extended bolus")
+	}
+	if len(running) == 0 {
+		return "suspended"
+	}
+	return strings.Join(running, ", ")
+}
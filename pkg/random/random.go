@@ -0,0 +1,93 @@
+// Package random is where the pod gets its keys, nonces and IVs. By default
+// they come from crypto/rand. With a seed they are reproducible: seed 0 gives
+// the fixed values the simulator used to hardcode, which match the vectors
+// in scripts/testdata/from_logs.ini, other seeds give a repeatable sequence.
+package random
+
+import (
+	"crypto/rand"
+	"fmt"
+	"hash/fnv"
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	mtx    sync.Mutex
+	seeded bool
+	seed   int64
+	source *mrand.Rand
+)
+
+// UseSeed makes all the following values deterministic
+func UseSeed(s int64) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	log.Warnf("pkg random; using seed %d for keys, nonces and IVs. debugging only", s)
+	seeded = true
+	seed = s
+	source = mrand.New(mrand.NewSource(s))
+}
+
+// UseCryptoRand goes back to the default, crypto/rand
+func UseCryptoRand() {
+	mtx.Lock()
+	defer mtx.Unlock()
+	seeded = false
+	source = nil
+}
+
+// Bytes returns n random bytes. With seed 0 every byte is fixed.
+func Bytes(n int, fixed byte) ([]byte, error) {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	ret := make([]byte, n)
+	switch {
+	case !seeded:
+		if _, err := rand.Read(ret); err != nil {
+			return nil, fmt.Errorf("could not read random bytes: %w", err)
+		}
+	case seed == 0:
+		for i := range ret {
+			ret[i] = fixed
+		}
+	default:
+		source.Read(ret)
+	}
+	return ret, nil
+}
+
+// Source gives the numbers for the simulated failure rates of one pod. Each
+// pod has its own, so a seeded run does not depend on how the calls of the
+// pods interleave.
+type Source struct {
+	mtx  sync.Mutex
+	rand *mrand.Rand
+}
+
+// NewSource returns the source of the pod called name. With a seed its
+// sequence only depends on the seed and the name, it is repeatable but
+// never fixed.
+func NewSource(name string) *Source {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	s := time.Now().UnixNano()
+	if seeded {
+		s = seed
+	}
+	return &Source{rand: mrand.New(mrand.NewSource(s ^ int64(h.Sum64())))}
+}
+
+// Float64 returns a number in [0.0, 1.0)
+func (s *Source) Float64() float64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.rand.Float64()
+}
@@ -1,15 +1,32 @@
 package response
 
 import (
+	"bytes"
 	"encoding/hex"
 )
 
+// deactivated is the 0x1d a pod sends once deactivated
+var deactivated, _ = hex.DecodeString("1D0F050648000038B6F3")
+
+// DeactivateResponse is the 0x1d a pod sends once deactivated, the general
+// status of an inactive pod. Unmarshal returns it for every 0x1d with pod
+// progress PodInactive.
 type DeactivateResponse struct {
-	Seq uint16
+	Seq    uint16
+	Status *GeneralStatusResponse // the response of a just deactivated pod when nil
 }
 
 func (r *DeactivateResponse) Marshal() ([]byte, error) {
-	response, _ := hex.DecodeString("1D0F050648000038B6F3")
+	if r.Status != nil {
+		return r.Status.Marshal()
+	}
+	return append([]byte(nil), deactivated...), nil
+}
 
-	return response, nil
+// unmarshalDeactivateResponse decodes the 0x1d of an inactive pod
+func unmarshalDeactivateResponse(data []byte, status *GeneralStatusResponse) *DeactivateResponse {
+	if bytes.Equal(data, deactivated) {
+		return &DeactivateResponse{}
+	}
+	return &DeactivateResponse{Status: status}
 }
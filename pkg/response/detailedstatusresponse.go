@@ -2,6 +2,7 @@ package response
 
 import (
 	"encoding/hex"
+	"fmt"
 )
 
 type DetailedStatusResponse struct {
@@ -79,9 +80,33 @@ func (r *DetailedStatusResponse) Marshal() ([]byte, error) {
 	response[16] = byte(r.MinutesActive & 0xff)
 
 	// Set active alert slot bits
-	response[6] = r.Alerts
+	response[17] = r.Alerts
 
 	// TODO: add other fault details
 
 	return response, nil
 }
+
+// UnmarshalDetailedStatusResponse decodes a type 2 0x02 response. A reservoir
+// above 50U is reported as 0x3ff pulses.
+func UnmarshalDetailedStatusResponse(data []byte) (*DetailedStatusResponse, error) {
+	if len(data) != 24 || int(data[1])+2 != len(data) || data[2] != 0x02 {
+		return nil, fmt.Errorf("invalid length when unmarshaling DetailedStatusResponse %x", data)
+	}
+	return &DetailedStatusResponse{
+		PodProgress:         PodProgress(data[3]),
+		BasalActive:         data[4]&(1<<0) != 0,
+		TempBasalActive:     data[4]&(1<<1) != 0,
+		BolusActive:         data[4]&(1<<2) != 0,
+		ExtendedBolusActive: data[4]&(1<<3) != 0,
+		BolusRemaining:      uint16(data[5])<<8 | uint16(data[6]),
+		LastProgSeqNum:      data[7],
+		Delivered:           uint16(data[8])<<8 | uint16(data[9]),
+		FaultEvent:          data[10],
+		IsFaulted:           data[10] != 0,
+		FaultEventTime:      uint16(data[11])<<8 | uint16(data[12]),
+		Reservoir:           uint16(data[13]&0b11)<<8 | uint16(data[14]),
+		MinutesActive:       uint16(data[15])<<8 | uint16(data[16]),
+		Alerts:              data[17],
+	}, nil
+}
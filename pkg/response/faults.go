@@ -0,0 +1,148 @@
+package response
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Alert slots, as reported in the status responses
+const (
+	AlertSlotAutoOff           = 1 << 0
+	AlertSlotShutdownImminent  = 1 << 2
+	AlertSlotExpirationAdvisor = 1 << 3
+	AlertSlotLowReservoir      = 1 << 4
+	AlertSlotSuspendInProgress = 1 << 5
+	AlertSlotSuspendEnded      = 1 << 6
+	AlertSlotExpired           = 1 << 7
+)
+
+// Fault codes the simulator gives special treatment
+const (
+	FaultOccluded       = 0x14
+	FaultReservoirEmpty = 0x18
+	FaultPodExpired     = 0x1c
+)
+
+// Fault is a fault event code reported in the detailed status
+type Fault struct {
+	Code        uint8
+	Name        string
+	Description string
+	// Alert slots the pod has active when it faults this way
+	Alerts uint8
+}
+
+// Faults are the fault event codes we know of. Most of them are internal
+// errors of the pod firmware; the ones a user sees are occlusions, an empty
+// reservoir, an expired pod and the motor errors.
+var Faults = []Fault{
+	{0x01, "failed_flash_erase", "Flash erase failed", 0},
+	{0x02, "failed_flash_store", "Flash store failed", 0},
+	{0x03, "table_corruption_basal_subcommand", "Basal table corrupted", 0},
+	{0x05, "corruption_byte_720", "Memory corrupted at byte 720", 0},
+	{0x06, "data_corruption_in_test_rtc_interrupt", "Data corrupted in the RTC interrupt test", 0},
+	{0x07, "rtc_interrupt_handler_inconsistent_state", "RTC interrupt handler in an inconsistent state", 0},
+	{0x08, "value_greater_than_8", "Value greater than 8", 0},
+	{0x0a, "bf_0_not_equal_to_bf_1", "Redundant values do not match", 0},
+	{0x0b, "table_corruption_temp_basal_subcommand", "Temp basal table corrupted", 0},
+	{0x0d, "reset_due_to_cop", "Reset by the watchdog", 0},
+	{0x0e, "reset_due_to_illegal_opcode", "Reset by an illegal opcode", 0},
+	{0x0f, "reset_due_to_illegal_address", "Reset by an illegal address", 0},
+	{0x10, "reset_due_to_sawcop", "Reset by the SAW watchdog", 0},
+	{0x11, "corruption_in_byte_866", "Memory corrupted at byte 866", 0},
+	{0x12, "reset_due_to_lvd", "Reset by low voltage", 0},
+	{0x13, "message_length_too_long", "Message too long", 0},
+	{FaultOccluded, "occluded", "Occlusion, insulin could not be delivered", 0},
+	{0x15, "corruption_in_word_129", "Memory corrupted at word 129", 0},
+	{0x16, "corruption_in_byte_868", "Memory corrupted at byte 868", 0},
+	{0x17, "corruption_in_a_validated_table", "Validated table corrupted", 0},
+	{FaultReservoirEmpty, "reservoir_empty", "Reservoir empty", AlertSlotLowReservoir},
+	{0x19, "bad_power_switch_array_value_1", "Bad power switch array value 1", 0},
+	{0x1a, "bad_power_switch_array_value_2", "Bad power switch array value 2", 0},
+	{0x1b, "bad_load_cnth_value", "Bad motor load count", 0},
+	{FaultPodExpired, "pod_expired", "Maximum pod life of 80 hours exceeded", AlertSlotShutdownImminent | AlertSlotExpired},
+	{0x1d, "bad_state_command_1a_schedule_parse", "Could not parse the 0x1a schedule", 0},
+	{0x1e, "unexpected_state_in_register_upon_reset", "Unexpected register state on reset", 0},
+	{0x1f, "wrong_summary_for_table_129", "Wrong summary for table 129", 0},
+	{0x20, "validate_count_error_when_bolusing", "Pulse count error while bolusing", 0},
+	{0x21, "bad_timer_variable_state", "Bad timer state", 0},
+	{0x22, "unexpected_rtc_module_value_during_reset", "Unexpected RTC value on reset", 0},
+	{0x23, "problem_calibrate_timer", "Timer calibration failed", 0},
+	{0x26, "rtc_interrupt_handler_unexpected_call", "Unexpected RTC interrupt", 0},
+	{0x27, "missing_2_hour_alert_to_fill_tank", "Not filled within 2 hours", 0},
+	{0x28, "fault_event_setup_pod", "Fault during pod setup", 0},
+	{0x29, "auto_off_0", "Auto-off, no command received in time", AlertSlotAutoOff},
+	{0x2a, "auto_off_1", "Auto-off, no command received in time", AlertSlotAutoOff},
+	{0x2b, "auto_off_2", "Auto-off, no command received in time", AlertSlotAutoOff},
+	{0x2c, "auto_off_3", "Auto-off, no command received in time", AlertSlotAutoOff},
+	{0x2d, "auto_off_4", "Auto-off, no command received in time", AlertSlotAutoOff},
+	{0x2e, "auto_off_5", "Auto-off, no command received in time", AlertSlotAutoOff},
+	{0x2f, "auto_off_6", "Auto-off, no command received in time", AlertSlotAutoOff},
+	{0x30, "auto_off_7", "Auto-off, no command received in time", AlertSlotAutoOff},
+	{0x31, "insulin_delivery_command_error", "Insulin delivery command error", 0},
+	{0x32, "bad_value_startup_test", "Startup test failed", 0},
+	{0x33, "connected_pod_command_timeout", "Command timed out", 0},
+	{0x34, "reset_from_unknown_cause", "Reset from an unknown cause", 0},
+	{0x36, "error_flash_initialization", "Flash initialization failed", 0},
+	{0x37, "bad_piezo_value", "Bad piezo value", 0},
+	{0x38, "unexpected_value_byte_358", "Unexpected value at byte 358", 0},
+	{0x39, "problem_with_load_1_and_2", "Motor load problem", 0},
+	{0x3a, "a_greater_than_7_in_message", "Value greater than 7 in a message", 0},
+	{0x3b, "failed_test_saw_reset", "SAW reset test failed", 0},
+	{0x3c, "test_in_progress", "Test in progress", 0},
+	{0x3d, "problem_with_pump_anchor", "Pump anchor problem", 0},
+	{0x3e, "error_flash_write", "Flash write failed", 0},
+	{0x40, "encoder_count_too_high", "Motor encoder count too high", 0},
+	{0x41, "encoder_count_excessive_variance", "Motor encoder count varies too much", 0},
+	{0x42, "encoder_count_too_low", "Motor encoder count too low", 0},
+	{0x43, "encoder_count_problem", "Motor encoder count problem", 0},
+	{0x44, "check_voltage_open_wire_1", "Open wire on the motor, 1", 0},
+	{0x45, "check_voltage_open_wire_2", "Open wire on the motor, 2", 0},
+	{0x46, "problem_with_load_1_and_2_type_46", "Motor load problem, type 0x46", 0},
+	{0x47, "problem_with_load_1_and_2_type_47", "Motor load problem, type 0x47", 0},
+	{0x48, "bad_timer_calibration", "Bad timer calibration", 0},
+	{0x49, "bad_timer_ratios", "Bad timer ratios", 0},
+	{0x4a, "bad_timer_values", "Bad timer values", 0},
+	{0x4b, "trim_ics_too_close_to_0x1ff", "Timer trim too close to 0x1ff", 0},
+	{0x4c, "problem_finding_best_trim_value", "Could not find the timer trim", 0},
+	{0x4d, "bad_set_tpm1_multi_cases_value", "Bad timer setting", 0},
+}
+
+var faultsByCode = map[uint8]Fault{}
+var faultsByName = map[string]Fault{}
+
+func init() {
+	for _, f := range Faults {
+		faultsByCode[f.Code] = f
+		faultsByName[f.Name] = f
+	}
+}
+
+// LookupFault returns the catalog entry for code
+func LookupFault(code uint8) (Fault, bool) {
+	f, ok := faultsByCode[code]
+	return f, ok
+}
+
+// FaultName returns the name of code, or its hex value for unknown codes
+func FaultName(code uint8) string {
+	if f, ok := faultsByCode[code]; ok {
+		return f.Name
+	}
+	return fmt.Sprintf("0x%02x", code)
+}
+
+// ParseFault accepts a fault name from the catalog, or a code in decimal or
+// 0x hex. Codes that are not in the catalog are accepted too.
+func ParseFault(s string) (uint8, error) {
+	s = strings.TrimSpace(s)
+	if f, ok := faultsByName[strings.ToLower(s)]; ok {
+		return f.Code, nil
+	}
+	code, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unknown fault %q. Use a fault code, or a name like occluded, reservoir_empty or pod_expired", s)
+	}
+	return uint8(code), nil
+}
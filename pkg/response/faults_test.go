@@ -0,0 +1,26 @@
+package response
+
+import "testing"
+
+func TestParseFault(t *testing.T) {
+	for in, want := range map[string]uint8{
+		"occluded":        0x14,
+		"Reservoir_Empty": 0x18,
+		"0x1c":            0x1c,
+		"20":              0x14,
+		"0xfe":            0xfe, // not in the catalog
+	} {
+		got, err := ParseFault(in)
+		if err != nil || got != want {
+			t.Errorf("ParseFault(%q) = 0x%02x, %v, want 0x%02x", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "clogged", "0x100"} {
+		if _, err := ParseFault(in); err == nil {
+			t.Errorf("ParseFault(%q) should fail", in)
+		}
+	}
+	if FaultName(FaultPodExpired) != "pod_expired" || FaultName(0xfe) != "0xfe" {
+		t.Errorf("unexpected fault names")
+	}
+}
@@ -2,6 +2,7 @@ package response
 
 import (
 	"encoding/hex"
+	"fmt"
 )
 
 // This is the default for most 0x1d response
@@ -80,9 +81,9 @@ func (r *GeneralStatusResponse) Marshal() ([]byte, error) {
 	response[1] = response[1]&0b11110000 | (byte(r.PodProgress) & 0b1111)
 
 	// Total insulin delivered
-	response[2] = byte(r.Delivered >> 9)
+	response[2] = response[2]&0b11110000 | byte((r.Delivered>>9)&0b1111)
 	response[3] = byte((r.Delivered >> 1) & 0xff)
-	response[4] = response[4]&0b11111110 | uint8((r.Delivered&0b1)<<7)
+	response[4] = response[4]&0b01111111 | uint8((r.Delivered&0b1)<<7)
 
 	// LastProgSeqNum
 	response[4] = response[4]&0b10000111 | ((r.LastProgSeqNum & 0xf) << 3)
@@ -91,8 +92,11 @@ func (r *GeneralStatusResponse) Marshal() ([]byte, error) {
 	response[4] = response[4]&0b11111000 | uint8((r.BolusRemaining>>8)&0b111)
 	response[5] = uint8(r.BolusRemaining & 0xff)
 
-	// Set active alert slot bits
-	response[6] = response[6]&0b10000000 | (r.Alerts >> 1)
+	// Fault bit, then the active alert slot bits
+	response[6] = r.Alerts >> 1
+	if r.IsFaulted {
+		response[6] |= 1 << 7
+	}
 	response[7] = response[7]&0b01111111 | (r.Alerts << 7)
 
 	// Time Active Minutes
@@ -109,3 +113,27 @@ func (r *GeneralStatusResponse) Marshal() ([]byte, error) {
 
 	return response, nil
 }
+
+// UnmarshalGeneralStatusResponse decodes a 0x1d response. A reservoir above
+// 50U is reported as 0x3ff pulses.
+func UnmarshalGeneralStatusResponse(data []byte) (*GeneralStatusResponse, error) {
+	// 1d SS 0PPP SN NNNN FAAT TTRR RR, F is the fault bit
+	if len(data) != 10 || data[0] != 0x1d {
+		return nil, fmt.Errorf("invalid length when unmarshaling GeneralStatusResponse %x", data)
+	}
+	r := &GeneralStatusResponse{
+		ExtendedBolusActive: data[1]&(1<<7) != 0,
+		BolusActive:         data[1]&(1<<6) != 0,
+		TempBasalActive:     data[1]&(1<<5) != 0,
+		BasalActive:         data[1]&(1<<4) != 0,
+		PodProgress:         PodProgress(data[1] & 0b1111),
+		Delivered:           uint16(data[2]&0b1111)<<9 | uint16(data[3])<<1 | uint16(data[4]>>7),
+		LastProgSeqNum:      (data[4] >> 3) & 0xf,
+		BolusRemaining:      uint16(data[4]&0b111)<<8 | uint16(data[5]),
+		IsFaulted:           data[6]&(1<<7) != 0,
+		Alerts:              data[6]<<1 | data[7]>>7,
+		MinutesActive:       uint16(data[7]&0b01111111)<<6 | uint16(data[8]>>2),
+		Reservoir:           uint16(data[8]&0b11)<<8 | uint16(data[9]),
+	}
+	return r, nil
+}
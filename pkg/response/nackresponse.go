@@ -2,14 +2,36 @@ package response
 
 import (
 	"encoding/hex"
+	"fmt"
 )
 
+// NackResponse is the 0x06 error response: 06 03 EE FF 0P, with error code
+// EE, fault event FF and pod progress P
 type NackResponse struct {
 	Seq uint16
+	// 0 sends the 0x07 error the simulator always sent
+	ErrorCode   uint8
+	FaultEvent  uint8
+	PodProgress PodProgress
 }
 
 func (r *NackResponse) Marshal() ([]byte, error) {
-	response, _ := hex.DecodeString("0603070009")
+	if r.ErrorCode == 0 {
+		response, _ := hex.DecodeString("0603070009")
+		return response, nil
+	}
+	return []byte{0x06, 0x03, r.ErrorCode, r.FaultEvent, byte(r.PodProgress) & 0x0f}, nil
+}
 
-	return response, nil
+// UnmarshalNackResponse decodes a 0x06 response. The 0x07 error the simulator
+// always sent comes back with its error code, not as 0.
+func UnmarshalNackResponse(data []byte) (*NackResponse, error) {
+	if len(data) != 5 || data[0] != 0x06 || data[1] != 0x03 {
+		return nil, fmt.Errorf("invalid length when unmarshaling NackResponse %x", data)
+	}
+	return &NackResponse{
+		ErrorCode:   data[2],
+		FaultEvent:  data[3],
+		PodProgress: PodProgress(data[4] & 0x0f),
+	}, nil
 }
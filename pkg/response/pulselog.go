@@ -0,0 +1,33 @@
+package response
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// maxPulseLogEntries is how many pulse log entries fit in one response
+const maxPulseLogEntries = 50
+
+// writePulseLog adds 02 LL TT NNNN and the 4 byte entries, NNNN is n
+func writePulseLog(subtype byte, n uint16, entries []uint32) ([]byte, error) {
+	if len(entries) > maxPulseLogEntries {
+		return nil, fmt.Errorf("%d pulse log entries, at most %d fit in a response", len(entries), maxPulseLogEntries)
+	}
+	ret := []byte{0x02, byte(3 + 4*len(entries)), subtype, byte(n >> 8), byte(n)}
+	for _, e := range entries {
+		ret = append(ret, byte(e>>24), byte(e>>16), byte(e>>8), byte(e))
+	}
+	return ret, nil
+}
+
+// readPulseLog reads what writePulseLog adds
+func readPulseLog(subtype byte, data []byte) (uint16, []uint32, error) {
+	if len(data) < 5 || int(data[1])+2 != len(data) || data[2] != subtype || (len(data)-5)%4 != 0 {
+		return 0, nil, fmt.Errorf("invalid pulse log response %x", data)
+	}
+	entries := make([]uint32, 0, (len(data)-5)/4)
+	for i := 5; i < len(data); i += 4 {
+		entries = append(entries, binary.BigEndian.Uint32(data[i:i+4]))
+	}
+	return binary.BigEndian.Uint16(data[3:5]), entries, nil
+}
@@ -14,6 +14,49 @@ type Response interface {
 	Marshal() ([]byte, error)
 }
 
+// Unmarshal decodes a response payload, the bytes Marshal of the response
+// returns: without the header and the CRC. The general status of an
+// inactive pod decodes as a DeactivateResponse.
+func Unmarshal(data []byte) (Response, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("pkg response; response is too short: %x", data)
+	}
+	switch data[0] {
+	case 0x1d:
+		status, err := UnmarshalGeneralStatusResponse(data)
+		if err != nil {
+			return nil, err
+		}
+		if status.PodProgress == PodProgressPodInactive {
+			return unmarshalDeactivateResponse(data, status), nil
+		}
+		return status, nil
+	case 0x02:
+		if len(data) < 3 {
+			return nil, fmt.Errorf("pkg response; status response is too short: %x", data)
+		}
+		switch data[2] {
+		case 0x02:
+			return UnmarshalDetailedStatusResponse(data)
+		case 0x46:
+			return UnmarshalType46StatusResponse(data)
+		case 0x50:
+			return UnmarshalType50StatusResponse(data)
+		case 0x51:
+			return UnmarshalType51StatusResponse(data)
+		}
+		return nil, fmt.Errorf("pkg response; unknown status response type 0x%02x: %x", data[2], data)
+	case 0x01:
+		if data[1] == 0x1b {
+			return UnmarshalSetUniqueID(data)
+		}
+		return UnmarshalVersionResponse(data)
+	case 0x06:
+		return UnmarshalNackResponse(data)
+	}
+	return nil, fmt.Errorf("pkg response; unknown response type 0x%02x: %x", data[0], data)
+}
+
 type ResponseMetadata struct {
 	CmdSeq uint8
 	MsgSeq uint8
@@ -0,0 +1,199 @@
+package response
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshal_RoundTrip(t *testing.T) {
+	version := &PodVersion{
+		PM:        [3]byte{4, 10, 0},
+		PI:        [3]byte{1, 3, 0},
+		ProductID: 4,
+		Lot:       0x0123abcd,
+		Tid:       0x00fedcba,
+	}
+	for _, rsp := range []Response{
+		&GeneralStatusResponse{
+			Alerts:         AlertSlotAutoOff | AlertSlotSuspendInProgress | AlertSlotExpired,
+			BolusActive:    true,
+			BasalActive:    true,
+			PodProgress:    PodProgressRunningBelow50U,
+			Delivered:      0x1555,
+			BolusRemaining: 0x2aa,
+			MinutesActive:  0x1234,
+			Reservoir:      0x2cd,
+			LastProgSeqNum: 0xb,
+		},
+		&GeneralStatusResponse{
+			ExtendedBolusActive: true,
+			TempBasalActive:     true,
+			PodProgress:         PodProgressFault,
+			IsFaulted:           true,
+			Delivered:           0x0aaa,
+			BolusRemaining:      0x555,
+			Alerts:              AlertSlotLowReservoir,
+			MinutesActive:       0x0dcb,
+			Reservoir:           0x3ff,
+			LastProgSeqNum:      0x4,
+		},
+		&DetailedStatusResponse{
+			Alerts:          AlertSlotShutdownImminent | AlertSlotExpired,
+			TempBasalActive: true,
+			BolusActive:     true,
+			PodProgress:     PodProgressFault,
+			Delivered:       0x1234,
+			BolusRemaining:  0x0113,
+			IsFaulted:       true,
+			MinutesActive:   0x1234,
+			Reservoir:       0x123,
+			LastProgSeqNum:  7,
+			FaultEvent:      FaultPodExpired,
+			FaultEventTime:  0x12c0,
+		},
+		&VersionResponse{
+			Version:     version,
+			PodProgress: PodProgressReminderInitialized,
+			Gain:        2,
+			RSSI:        0x2a,
+			PodID:       []byte{0xff, 0xff, 0xff, 0xff},
+		},
+		&VersionResponse{Version: version, PodProgress: PodProgressRunningAbove50U, PodID: []byte{0x17, 0x13, 0x9b, 0x1f}},
+		&SetUniqueID{Version: version, PodProgress: PodProgressPairingCompleted, PodID: []byte{0x17, 0x13, 0x9b, 0x1f}},
+		&DeactivateResponse{},
+		&DeactivateResponse{Status: &GeneralStatusResponse{PodProgress: PodProgressPodInactive, Delivered: 0x200, MinutesActive: 0x40}},
+		&NackResponse{ErrorCode: 0x14, FaultEvent: FaultOccluded, PodProgress: PodProgressFault},
+		&GeneralStatusResponse{PodProgress: PodProgressFault, Alerts: 0xff},
+		&Type46StatusResponse{Value: 0x1234},
+		&Type50StatusResponse{LastEntry: 0x0f18, Log: []uint32{0x4c902a00, 0x51903200}},
+		&Type50StatusResponse{Log: []uint32{}},
+		&Type51StatusResponse{Entries: 1, Log: []uint32{0x4c902701}},
+	} {
+		data, err := rsp.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Unmarshal(data)
+		if err != nil {
+			t.Errorf("%T: %s", rsp, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, rsp) {
+			t.Errorf("%x decoded as %+v, want %+v", data, got, rsp)
+		}
+	}
+}
+
+func TestUnmarshal_PodMessages(t *testing.T) {
+	for _, msg := range []string{
+		"1d58001cc014000013ff",
+		"021602080200000001b200000003ff01cc0000001fff030d",
+	} {
+		data, _ := hex.DecodeString(msg)
+		rsp, err := Unmarshal(data)
+		if err != nil {
+			t.Errorf("%s: %s", msg, err)
+			continue
+		}
+		if b, _ := rsp.Marshal(); hex.EncodeToString(b) != msg {
+			t.Errorf("%s marshaled back as %x", msg, b)
+		}
+	}
+
+	data, _ := hex.DecodeString("1d58001cc014000013ff")
+	rsp, _ := Unmarshal(data)
+	want := &GeneralStatusResponse{
+		BolusActive:    true,
+		BasalActive:    true,
+		PodProgress:    PodProgressRunningAbove50U,
+		Delivered:      57,
+		LastProgSeqNum: 8,
+		BolusRemaining: 20,
+		MinutesActive:  4,
+		Reservoir:      0x3ff,
+	}
+	if !reflect.DeepEqual(rsp, want) {
+		t.Errorf("got %+v, want %+v", rsp, want)
+	}
+}
+
+func TestUnmarshal_PulseLog(t *testing.T) {
+	for _, rsp := range []Response{&Type50StatusResponse{}, &Type51StatusResponse{}} {
+		data, _ := rsp.Marshal()
+		got, err := Unmarshal(data)
+		if err != nil {
+			t.Fatalf("%T: %s", rsp, err)
+		}
+		switch r := got.(type) {
+		case *Type50StatusResponse:
+			if r.LastEntry != 0x0f18 || len(r.Log) != 50 || r.Log[0] != 0x4c902a00 {
+				t.Errorf("unexpected recent pulse log: %x, %x", r.LastEntry, r.Log)
+			}
+		case *Type51StatusResponse:
+			if r.Entries != 50 || len(r.Log) != 50 || r.Log[49] != 0x49913000 {
+				t.Errorf("unexpected previous pulse log: %d, %x", r.Entries, r.Log)
+			}
+		}
+		if b, _ := got.Marshal(); !reflect.DeepEqual(b, data) {
+			t.Errorf("%x marshaled back as %x", data, b)
+		}
+	}
+	if _, err := (&Type50StatusResponse{Log: make([]uint32, 51)}).Marshal(); err == nil {
+		t.Errorf("51 entries should not fit")
+	}
+}
+
+func TestUnmarshal_Deactivate(t *testing.T) {
+	data, _ := (&DeactivateResponse{}).Marshal()
+	rsp, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := rsp.(*DeactivateResponse); !ok || r.Status != nil {
+		t.Errorf("unexpected deactivate response: %+v", rsp)
+	}
+	if b, _ := rsp.Marshal(); !reflect.DeepEqual(b, data) {
+		t.Errorf("%x marshaled back as %x", data, b)
+	}
+}
+
+func TestUnmarshal_Defaults(t *testing.T) {
+	// what the pod sends when the version and the id are not set
+	for _, tc := range []struct {
+		rsp  Response
+		want string
+	}{
+		{&VersionResponse{PodProgress: PodProgressReminderInitialized}, "0115040a00010300040208146db10006e45100ffffffff"},
+		{&SetUniqueID{PodProgress: PodProgressPairingCompleted}, "011b13881008340a50040a00010300040308146db10006e45100001091"},
+	} {
+		data, err := tc.rsp.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(data) != tc.want {
+			t.Errorf("%T marshaled as %x, want %s", tc.rsp, data, tc.want)
+		}
+	}
+	if _, err := (&VersionResponse{PodID: []byte{1, 2}}).Marshal(); err == nil {
+		t.Errorf("a short pod id should fail")
+	}
+}
+
+func TestUnmarshal_Invalid(t *testing.T) {
+	for _, msg := range []string{
+		"",
+		"1d58001cc014000013",
+		"0216020802",
+		"021602080200000001b200000003ff01cc0000001fff03",
+		"020347",
+		"0603070009ff",
+		"0116",
+		"ff00",
+	} {
+		data, _ := hex.DecodeString(msg)
+		if _, err := Unmarshal(data); err == nil {
+			t.Errorf("%q should fail", msg)
+		}
+	}
+}
@@ -1,17 +1,38 @@
 package response
 
 import (
-	"encoding/hex"
+	"bytes"
+	"fmt"
 )
 
 // This is the special case - sent with the 0x011B response to 0x03 message
 
 type SetUniqueID struct {
-	Seq uint16
+	Seq         uint16
+	Version     *PodVersion // DefaultPodVersion when nil
+	PodProgress PodProgress
+	PodID       []byte // 00001091 when nil
 }
 
 func (r *SetUniqueID) Marshal() ([]byte, error) {
-	response, _ := hex.DecodeString("011B13881008340A50040A00010300040308146DB10006E45100001091")
+	if r.PodID != nil && len(r.PodID) != 4 {
+		return nil, fmt.Errorf("invalid pod id %x", r.PodID)
+	}
+	var buf bytes.Buffer
+	buf.Write([]byte{0x01, 0x1b, 0x13, 0x88, 0x10, 0x08, 0x34, 0x0a, 0x50})
+	r.Version.write(&buf, r.PodProgress)
+	writePodID(&buf, r.PodID, []byte{0x00, 0x00, 0x10, 0x91})
 
-	return response, nil
+	return buf.Bytes(), nil
+}
+
+// UnmarshalSetUniqueID decodes a 0x011b response
+func UnmarshalSetUniqueID(data []byte) (*SetUniqueID, error) {
+	// 01 1b 13881008340a50 MXMYMZ IXIYIZ ID 0J LLLLLLLL TTTTTTTT IIIIIIII
+	if len(data) != 0x1b+2 || data[0] != 0x01 || data[1] != 0x1b {
+		return nil, fmt.Errorf("invalid length when unmarshaling SetUniqueID %x", data)
+	}
+	r := &SetUniqueID{PodID: append([]byte(nil), data[25:29]...)}
+	r.Version, r.PodProgress = readPodVersion(data[9:])
+	return r, nil
 }
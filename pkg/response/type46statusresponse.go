@@ -1,14 +1,28 @@
 package response
 
 import (
-	"encoding/hex"
+	"encoding/binary"
+	"fmt"
 )
 
+// Type46StatusResponse answers a 0x0e with type 0x46. The pods answer it
+// with two zero bytes, what they mean is not known.
 type Type46StatusResponse struct {
-	Seq uint16
+	Seq   uint16
+	Value uint16
 }
 
 func (r *Type46StatusResponse) Marshal() ([]byte, error) {
-	response, _ := hex.DecodeString("0204460000")
+	// 02 03 46 VVVV
+	response := []byte{0x02, 0x03, 0x46, 0, 0}
+	binary.BigEndian.PutUint16(response[3:], r.Value)
 	return response, nil
 }
+
+// UnmarshalType46StatusResponse decodes a type 0x46 0x02 response
+func UnmarshalType46StatusResponse(data []byte) (*Type46StatusResponse, error) {
+	if len(data) != 5 || data[1] != 3 || data[2] != 0x46 {
+		return nil, fmt.Errorf("invalid length when unmarshaling Type46StatusResponse %x", data)
+	}
+	return &Type46StatusResponse{Value: binary.BigEndian.Uint16(data[3:5])}, nil
+}
@@ -2,14 +2,33 @@ package response
 
 import (
 	"encoding/hex"
+	"fmt"
 )
 
+// Type50StatusResponse answers a 0x0e with type 0x50: the last entries of
+// the pulse log, up to 50.
 type Type50StatusResponse struct {
-	Seq uint16
+	Seq       uint16
+	LastEntry uint16   // index of the last entry written to the log
+	Log       []uint32 // the entries, the default log when nil
 }
 
+// defaultRecentPulseLog is what the simulator sends when Log is nil
+var defaultRecentPulseLog, _ = hex.DecodeString("02CB500F184C902A005190320054912A80599033805C902B80019133BF04912ABF099033BF0C312ABF119033BF149029BF199134BF1C91283F2190323F24902A3F2990333F2C912A3F3190353F34912A3F3991353F3C312A3F4191363F44902A3F4931343F4C31293F5131343F5431293F5931353F5C312ABF613035BF643029BF0131338104312981093033810C302A811130308114312A81193031011C302A012131320124312A01293133012C312A013130320134312A01393131013C312B014130320144312B0149303001")
+
 func (r *Type50StatusResponse) Marshal() ([]byte, error) {
-	response, _ := hex.DecodeString("02CB500F184C902A005190320054912A80599033805C902B80019133BF04912ABF099033BF0C312ABF119033BF149029BF199134BF1C91283F2190323F24902A3F2990333F2C912A3F3190353F34912A3F3991353F3C312A3F4191363F44902A3F4931343F4C31293F5131343F5431293F5931353F5C312ABF613035BF643029BF0131338104312981093033810C302A811130308114312A81193031011C302A012131320124312A01293133012C312A013130320134312A01393131013C312B014130320144312B0149303001")
+	if r.Log == nil {
+		return append([]byte(nil), defaultRecentPulseLog...), nil
+	}
+	// 02 LL 50 IIII XXXXXXXX...
+	return writePulseLog(0x50, r.LastEntry, r.Log)
+}
 
-	return response, nil
+// UnmarshalType50StatusResponse decodes a type 0x50 0x02 response
+func UnmarshalType50StatusResponse(data []byte) (*Type50StatusResponse, error) {
+	n, log, err := readPulseLog(0x50, data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid length when unmarshaling Type50StatusResponse %x", data)
+	}
+	return &Type50StatusResponse{LastEntry: n, Log: log}, nil
 }
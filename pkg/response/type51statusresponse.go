@@ -2,14 +2,33 @@ package response
 
 import (
 	"encoding/hex"
+	"fmt"
 )
 
+// Type51StatusResponse answers a 0x0e with type 0x51: up to 50 entries of
+// the pulse log before the ones of type 0x50.
 type Type51StatusResponse struct {
-	Seq uint16
+	Seq     uint16
+	Entries uint16   // how many entries are in the response
+	Log     []uint32 // the entries, the default log when nil
 }
 
+// defaultPreviousPulseLog is what the simulator sends when Log is nil
+var defaultPreviousPulseLog, _ = hex.DecodeString("02CB5100324C90270151902F015490270159902F815C91268161902F810091268005902F80089028800D302F801091278015902F80189026801D902F002091270025903100289028002D9031003090280035903100389129003D3131004091280045913100489027004D9030005090280055913100589128805D913180609128800190318004912980093031800C902980119130801491288019912E801C9128002191320024902900299132002C9129003190330034902A00393132003C912A004190320044902B0049913000")
+
 func (r *Type51StatusResponse) Marshal() ([]byte, error) {
-	response, _ := hex.DecodeString("02CB5100324C90270151902F015490270159902F815C91268161902F810091268005902F80089028800D302F801091278015902F80189026801D902F002091270025903100289028002D9031003090280035903100389129003D3131004091280045913100489027004D9030005090280055913100589128805D913180609128800190318004912980093031800C902980119130801491288019912E801C9128002191320024902900299132002C9129003190330034902A00393132003C912A004190320044902B0049913000")
+	if r.Log == nil {
+		return append([]byte(nil), defaultPreviousPulseLog...), nil
+	}
+	// 02 LL 51 NNNN XXXXXXXX...
+	return writePulseLog(0x51, r.Entries, r.Log)
+}
 
-	return response, nil
+// UnmarshalType51StatusResponse decodes a type 0x51 0x02 response
+func UnmarshalType51StatusResponse(data []byte) (*Type51StatusResponse, error) {
+	n, log, err := readPulseLog(0x51, data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid length when unmarshaling Type51StatusResponse %x", data)
+	}
+	return &Type51StatusResponse{Entries: n, Log: log}, nil
 }
@@ -1,17 +1,96 @@
 package response
 
 import (
-	"encoding/hex"
+	"bytes"
+	"encoding/binary"
+	"fmt"
 )
 
 // This is the special case - sent with the 0x0115 response to 0x07 message
 
 type VersionResponse struct {
-	Seq uint16
+	Seq         uint16
+	Version     *PodVersion // DefaultPodVersion when nil
+	PodProgress PodProgress
+	Gain        uint8  // 2 bits
+	RSSI        uint8  // 6 bits
+	PodID       []byte // ffffffff when nil, the pod has no id before 0x03
+}
+
+// PodVersion is what the pod reports about itself in the 0x0115 and 0x011b responses
+type PodVersion struct {
+	PM        [3]byte // firmware version
+	PI        [3]byte // BLE firmware version
+	ProductID byte
+	Lot       uint32
+	Tid       uint32
+}
+
+var DefaultPodVersion = PodVersion{
+	PM:        [3]byte{4, 10, 0},
+	PI:        [3]byte{1, 3, 0},
+	ProductID: 4,
+	Lot:       0x08146DB1,
+	Tid:       0x0006E451,
+}
+
+// write adds MXMYMZ IXIYIZ ID 0J LLLLLLLL TTTTTTTT
+func (v *PodVersion) write(buf *bytes.Buffer, podProgress PodProgress) {
+	if v == nil {
+		v = &DefaultPodVersion
+	}
+	buf.Write(v.PM[:])
+	buf.Write(v.PI[:])
+	buf.WriteByte(v.ProductID)
+	buf.WriteByte(byte(podProgress))
+	binary.Write(buf, binary.BigEndian, v.Lot)
+	binary.Write(buf, binary.BigEndian, v.Tid)
+}
+
+// readPodVersion reads what write adds
+func readPodVersion(data []byte) (*PodVersion, PodProgress) {
+	v := &PodVersion{
+		ProductID: data[6],
+		Lot:       binary.BigEndian.Uint32(data[8:12]),
+		Tid:       binary.BigEndian.Uint32(data[12:16]),
+	}
+	copy(v.PM[:], data[0:3])
+	copy(v.PI[:], data[3:6])
+	return v, PodProgress(data[7] & 0xf)
+}
+
+// writePodID adds IIIIIIII, def when id is nil
+func writePodID(buf *bytes.Buffer, id, def []byte) {
+	if id == nil {
+		id = def
+	}
+	buf.Write(id)
 }
 
 func (r *VersionResponse) Marshal() ([]byte, error) {
-	response, _ := hex.DecodeString("0115040A00010300040208146DB10006E45100FFFFFFFF")
+	if r.PodID != nil && len(r.PodID) != 4 {
+		return nil, fmt.Errorf("invalid pod id %x", r.PodID)
+	}
+	var buf bytes.Buffer
+	buf.Write([]byte{0x01, 0x15})
+	r.Version.write(&buf, r.PodProgress)
+	buf.WriteByte(r.Gain<<6 | r.RSSI&0x3f)
+	writePodID(&buf, r.PodID, []byte{0xff, 0xff, 0xff, 0xff})
+
+	return buf.Bytes(), nil
+}
 
-	return response, nil
+// UnmarshalVersionResponse decodes a 0x0115 response
+func UnmarshalVersionResponse(data []byte) (*VersionResponse, error) {
+	// 01 15 MXMYMZ IXIYIZ ID 0J LLLLLLLL TTTTTTTT GS IIIIIIII
+	if len(data) != 0x15+2 || data[0] != 0x01 || data[1] != 0x15 {
+		return nil, fmt.Errorf("invalid length when unmarshaling VersionResponse %x", data)
+	}
+	r := &VersionResponse{
+		Gain:  data[18] >> 6,
+		RSSI:  data[18] & 0x3f,
+		PodID: append([]byte(nil), data[19:23]...),
+	}
+	r.Version, r.PodProgress = readPodVersion(data[2:])
+	return r, nil
 }